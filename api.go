@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
@@ -8,6 +9,7 @@ import (
 
 	"net/http"
 
+	"github.com/johan-st/go-image-server/images"
 	"github.com/johan-st/go-image-server/units/size"
 	"github.com/johan-st/go-image-server/way"
 )
@@ -41,6 +43,55 @@ func (srv *server) handleApiImageGet() http.HandlerFunc {
 	}
 }
 
+func (srv *server) handleApiImageInfo() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiImageInfo")
+
+	type responseOK struct {
+		Id int `json:"id"`
+		images.Info
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		id_str := way.Param(r.Context(), "id")
+		l.Debug("handling info request", "id", id_str)
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			l.Warn("error while parsing id", "id", id_str, "ParseIntError", err)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("id must be an integer, got '%s'", id_str),
+			})
+			return
+		}
+
+		info, err := srv.ih.Info(id)
+		if err != nil {
+			if errors.Is(err, images.ErrIdNotFound{}) {
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", id),
+				})
+				return
+			}
+			l.Error("error while reading image info", "id", id, "ImageHandlerError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
+		}
+		srv.respondJson(w, r, http.StatusOK, responseOK{Id: id, Info: info})
+	}
+}
+
 func (srv *server) handleApiImageDelete() http.HandlerFunc {
 	// setup
 	l := srv.errorLogger.With("handler", "handleApiImageDelete")
@@ -85,10 +136,12 @@ func (srv *server) handleApiImagePost() http.HandlerFunc {
 	l.With("method", "POST")
 
 	type responseOK struct {
-		Status  int    `json:"status"`
-		Message string `json:"message"`
-		Id      int    `json:"id"`
-		Url     string `json:"url"`
+		Status      int                 `json:"status"`
+		Message     string              `json:"message"`
+		Id          int                 `json:"id"`
+		Url         string              `json:"url"`
+		Duplicate   bool                `json:"duplicate"`
+		Placeholder *images.Placeholder `json:"placeholder,omitempty"`
 	}
 
 	type responseErr struct {
@@ -136,7 +189,8 @@ func (srv *server) handleApiImagePost() http.HandlerFunc {
 
 		// add to image handler
 		id, err := srv.ih.Add(upload)
-		if err != nil {
+		duplicate := errors.Is(err, images.ErrDuplicate{})
+		if err != nil && !duplicate {
 			if errors.Is(err, image.ErrFormat) {
 				l.Warn("Error while adding image to handler", "AddIOError", err)
 				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
@@ -146,9 +200,18 @@ func (srv *server) handleApiImagePost() http.HandlerFunc {
 				return
 			}
 			l.Error("Error while adding image to handler", "AddIOError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
 		}
 
-		l.Info("File Uploaded Successfully", "assigned id", id, "original filename", header.Filename, "upload size", header.Size)
+		status, message := http.StatusCreated, "File Uploaded Successfully"
+		if duplicate {
+			status, message = http.StatusOK, "File Already Exists"
+		}
+		l.Info(message, "assigned id", id, "original filename", header.Filename, "upload size", header.Size)
 
 		// var url string
 		// if srv.conf.Port == 0 || srv.conf.Port == 80 {
@@ -158,12 +221,481 @@ func (srv *server) handleApiImagePost() http.HandlerFunc {
 		// }
 
 		response := responseOK{
-			Status:  http.StatusCreated,
-			Message: "File Uploaded Successfully",
-			Id:      id,
-			Url:     fmt.Sprintf("/%d", id),
+			Status:    status,
+			Message:   message,
+			Id:        id,
+			Url:       fmt.Sprintf("/%d", id),
+			Duplicate: duplicate,
+		}
+		placeholder, err := srv.ih.Placeholder(id)
+		if err != nil {
+			l.Warn("Could not create placeholder", "id", id, "PlaceholderError", err)
+		} else {
+			response.Placeholder = &placeholder
+		}
+
+		srv.respondJson(w, r, status, response)
+	}
+}
+
+func (srv *server) handleApiImageFocus() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiImageFocus")
+
+	type responseOK struct {
+		Id    int               `json:"id"`
+		Focus images.FocalPoint `json:"focus"`
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		id_str := way.Param(r.Context(), "id")
+		l.Debug("handling focus request", "method", r.Method, "id", id_str)
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			l.Warn("error while parsing id", "id", id_str, "ParseIntError", err)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("id must be an integer, got '%s'", id_str),
+			})
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			fp := images.FocalPoint{}
+			err = json.NewDecoder(r.Body).Decode(&fp)
+			if err != nil {
+				l.Warn("error while decoding focal point", "id", id, "DecodeError", err)
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  "body must be a json object with x and y, e.g. {\"x\": 0.5, \"y\": 0.3}",
+				})
+				return
+			}
+			err = srv.ih.SetFocus(id, fp)
 		}
 
-		srv.respondJson(w, r, http.StatusCreated, response)
+		focus := images.FocalPoint{}
+		if err == nil {
+			focus, err = srv.ih.Focus(id)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, images.ErrIdNotFound{}):
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", id),
+				})
+			case errors.Is(err, images.ErrInvalidFocalPoint{}):
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  err.Error(),
+				})
+			default:
+				l.Error("error while handling focal point", "id", id, "ImageHandlerError", err)
+				srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+					Status: http.StatusInternalServerError,
+					Error:  "Internal Server Error",
+				})
+			}
+			return
+		}
+		srv.respondJson(w, r, http.StatusOK, responseOK{Id: id, Focus: focus})
+	}
+}
+
+func (srv *server) handleApiImagePlaceholder() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiImagePlaceholder")
+
+	type responseOK struct {
+		Id          int                `json:"id"`
+		Placeholder images.Placeholder `json:"placeholder"`
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		id_str := way.Param(r.Context(), "id")
+		l.Debug("handling placeholder request", "id", id_str)
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			l.Warn("error while parsing id", "id", id_str, "ParseIntError", err)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("id must be an integer, got '%s'", id_str),
+			})
+			return
+		}
+
+		placeholder, err := srv.ih.Placeholder(id)
+		if err != nil {
+			if errors.Is(err, images.ErrIdNotFound{}) {
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", id),
+				})
+				return
+			}
+			l.Error("error while creating placeholder", "id", id, "ImageHandlerError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
+		}
+		srv.respondJson(w, r, http.StatusOK, responseOK{Id: id, Placeholder: placeholder})
+	}
+}
+
+func (srv *server) handleApiImageColors() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiImageColors")
+
+	type responseOK struct {
+		Id     int           `json:"id"`
+		Colors images.Colors `json:"colors"`
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		id_str := way.Param(r.Context(), "id")
+		l.Debug("handling colors request", "id", id_str)
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			l.Warn("error while parsing id", "id", id_str, "ParseIntError", err)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("id must be an integer, got '%s'", id_str),
+			})
+			return
+		}
+
+		n := images.DefaultPaletteSize
+		if n_str := r.URL.Query().Get("n"); n_str != "" {
+			n, err = strconv.Atoi(n_str)
+			if err != nil {
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  fmt.Sprintf("n must be an integer, got '%s'", n_str),
+				})
+				return
+			}
+		}
+
+		colors, err := srv.ih.Colors(id, n)
+		if err != nil {
+			if errors.Is(err, images.ErrInvalidPaletteSize{}) {
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  err.Error(),
+				})
+				return
+			}
+			if errors.Is(err, images.ErrIdNotFound{}) {
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", id),
+				})
+				return
+			}
+			l.Error("error while extracting colors", "id", id, "ImageHandlerError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
+		}
+		srv.respondJson(w, r, http.StatusOK, responseOK{Id: id, Colors: colors})
+	}
+}
+
+func (srv *server) handleApiImageSimilar() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiImageSimilar")
+
+	type responseOK struct {
+		Id      int              `json:"id"`
+		Similar []images.Similar `json:"similar"`
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		id_str := way.Param(r.Context(), "id")
+		l.Debug("handling similar request", "id", id_str)
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			l.Warn("error while parsing id", "id", id_str, "ParseIntError", err)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("id must be an integer, got '%s'", id_str),
+			})
+			return
+		}
+
+		maxDistance := images.DefaultSimilarDistance
+		if d_str := r.URL.Query().Get("max_distance"); d_str != "" {
+			maxDistance, err = strconv.Atoi(d_str)
+			if err != nil {
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  fmt.Sprintf("max_distance must be an integer, got '%s'", d_str),
+				})
+				return
+			}
+		}
+
+		similar, err := srv.ih.Similar(id, maxDistance)
+		if err != nil {
+			if errors.Is(err, images.ErrInvalidDistance{}) {
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  err.Error(),
+				})
+				return
+			}
+			if errors.Is(err, images.ErrIdNotFound{}) {
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", id),
+				})
+				return
+			}
+			l.Error("error while searching similar images", "id", id, "ImageHandlerError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
+		}
+		srv.respondJson(w, r, http.StatusOK, responseOK{Id: id, Similar: similar})
+	}
+}
+
+func (srv *server) handleApiImageSrcset() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiImageSrcset")
+
+	type responseOK struct {
+		Id int `json:"id"`
+		srcset
+		Placeholder *images.Placeholder `json:"placeholder,omitempty"`
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		id_str := way.Param(r.Context(), "id")
+		l.Debug("handling srcset request", "id", id_str)
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			l.Warn("error while parsing id", "id", id_str, "ParseIntError", err)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  fmt.Sprintf("id must be an integer, got '%s'", id_str),
+			})
+			return
+		}
+
+		query := r.URL.Query()
+		opts := srcsetOptions{
+			id:            id,
+			defaultFormat: srv.ih.DefaultFormat(),
+			maxDimension:  srv.ih.MaxDimension(),
+			widths:        defaultSrcsetWidths,
+			sizes:         "100vw",
+			alt:           query.Get("alt"),
+		}
+		errs := []error{}
+		if query.Has("preset") {
+			p, ok := srv.ih.GetPreset(query.Get("preset"))
+			if ok {
+				// the same urls for every alias
+				opts.presetName, opts.preset = p.Name, p
+				if p.Name == "" {
+					opts.presetName = query.Get("preset")
+				}
+			} else {
+				errs = append(errs, fmt.Errorf("unknown preset '%s'", query.Get("preset")))
+			}
+		}
+		if query.Has("widths") {
+			if v, err := parseSrcsetWidths(query.Get("widths")); err == nil {
+				opts.widths = v
+			} else {
+				errs = append(errs, err)
+			}
+		}
+		if query.Has("sizes") {
+			opts.sizes = query.Get("sizes")
+		}
+		withPlaceholder := false
+		if query.Has("placeholder") {
+			if v, err := strconv.ParseBool(query.Get("placeholder")); err == nil {
+				withPlaceholder = v
+			} else {
+				errs = append(errs, fmt.Errorf("placeholder must be true or false, got '%s'", query.Get("placeholder")))
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  err.Error(),
+			})
+			return
+		}
+
+		res := responseOK{Id: id}
+		opts.info, err = srv.ih.Info(id)
+		if err == nil && withPlaceholder {
+			var p images.Placeholder
+			p, err = srv.ih.Placeholder(id)
+			res.Placeholder = &p
+			opts.placeholder = p.DataUri
+		}
+		if err != nil {
+			if errors.Is(err, images.ErrIdNotFound{}) {
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", id),
+				})
+				return
+			}
+			l.Error("error while building srcset", "id", id, "ImageHandlerError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
+		}
+		res.srcset = buildSrcset(opts)
+		srv.respondJson(w, r, http.StatusOK, res)
+	}
+}
+
+// SHEETS
+
+func (srv *server) handleApiSheet() http.HandlerFunc {
+	// setup
+	l := srv.errorLogger.With("handler", "handleApiSheet")
+
+	type responseMap struct {
+		Url    string             `json:"url"`
+		Width  int                `json:"width"`
+		Height int                `json:"height"`
+		Cells  []images.SheetCell `json:"cells"`
+	}
+
+	type responseErr struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+
+	// handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		l.Debug("handling sheet request", "query", q)
+
+		sp, err := parseSheetParameters(q)
+		if err != nil {
+			l.Warn("could not parse sheet parameters", "err", err, "query", q)
+			srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+				Status: http.StatusBadRequest,
+				Error:  err.Error(),
+			})
+			return
+		}
+		asMap := false
+		if q.Has("map") {
+			asMap, err = strconv.ParseBool(q.Get("map"))
+			if err != nil {
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  fmt.Sprintf("map must be a boolean, got '%s'", q.Get("map")),
+				})
+				return
+			}
+		}
+		// a map describes the sheet in the format it was asked for
+		if sp.Format == images.Auto && !asMap {
+			sp.Format = negotiateFormat(r.Header.Get("Accept"), srv.ih.DefaultFormat())
+			w.Header().Add("Vary", "Accept")
+		}
+
+		path, cells, err := srv.ih.Sheet(sp)
+		if err != nil {
+			if errors.Is(err, images.ErrInvalidSheet{}) {
+				srv.respondJson(w, r, http.StatusBadRequest, responseErr{
+					Status: http.StatusBadRequest,
+					Error:  err.Error(),
+				})
+				return
+			}
+			var notFound images.ErrIdNotFound
+			if errors.As(err, &notFound) {
+				srv.respondJson(w, r, http.StatusNotFound, responseErr{
+					Status: http.StatusNotFound,
+					Error:  fmt.Sprintf("id '%d' was not found", notFound.IdGiven),
+				})
+				return
+			}
+			l.Error("error while creating sheet", "SheetParameters", sp, "ImageHandlerError", err)
+			srv.respondJson(w, r, http.StatusInternalServerError, responseErr{
+				Status: http.StatusInternalServerError,
+				Error:  "Internal Server Error",
+			})
+			return
+		}
+
+		if asMap {
+			q.Del("map")
+			width, height := 0, 0
+			for _, c := range cells {
+				if c.X+c.Width > width {
+					width = c.X + c.Width
+				}
+				if c.Y+c.Height > height {
+					height = c.Y + c.Height
+				}
+			}
+			srv.respondJson(w, r, http.StatusOK, responseMap{
+				Url:    r.URL.Path + "?" + q.Encode(),
+				Width:  width,
+				Height: height,
+				Cells:  cells,
+			})
+			return
+		}
+		l.Debug("serving sheet", "SheetParameters", sp, "file", path)
+		http.ServeFile(w, r, path)
+		srv.Stats.ImagesServed++
 	}
 }
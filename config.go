@@ -3,7 +3,9 @@ package main
 import (
 	"errors"
 	"fmt"
+	"image/color"
 	"os"
+	"strconv"
 
 	"github.com/johan-st/go-image-server/images"
 	"github.com/johan-st/go-image-server/units/size"
@@ -33,6 +35,10 @@ type confFiles struct {
 	SetPerms     bool `yaml:"set_perms"`
 	CreateDirs   bool `yaml:"create_dirs"`
 
+	BakeOrientation bool `yaml:"bake_orientation"`
+	ScrubGps        bool `yaml:"scrub_gps"`
+	Dedupe          bool `yaml:"dedupe"`
+
 	DirOriginals string `yaml:"originals_dir"`
 	DirCache     string `yaml:"cache_dir"`
 	PopulateFrom string `yaml:"populate_from"`
@@ -44,13 +50,22 @@ type confCache struct {
 }
 
 type confImageDefault struct {
-	Format        string `yaml:"format"`
-	QualityJpeg   int    `yaml:"quality_jpeg"`
-	QualityGif    int    `yaml:"quality_gif"`
-	Width         int    `yaml:"width"`
-	Height        int    `yaml:"height"`
-	MaxSize       string `yaml:"max_size"`
-	Interpolation string `yaml:"interpolation"`
+	Format         string `yaml:"format"`
+	QualityJpeg    int    `yaml:"quality_jpeg"`
+	QualityGif     int    `yaml:"quality_gif"`
+	QualityWebp    int    `yaml:"quality_webp"`
+	QualityPng     int    `yaml:"quality_png"`
+	QualityPng8    int    `yaml:"quality_png8"`
+	Width          int    `yaml:"width"`
+	Height         int    `yaml:"height"`
+	MaxSize        string `yaml:"max_size"`
+	Interpolation  string `yaml:"interpolation"`
+	Metadata       string `yaml:"metadata"`
+	Fit            string `yaml:"fit"`
+	Background     string `yaml:"background"`
+	Dither         string `yaml:"dither"`
+	MaxDimension   int    `yaml:"max_dimension"`
+	DprCapOriginal bool   `yaml:"dpr_cap_original"`
 }
 
 type confImagePreset struct {
@@ -58,10 +73,109 @@ type confImagePreset struct {
 	Alias         []string `yaml:"alias"`
 	Format        string   `yaml:"format,omitempty"`
 	Quality       int      `yaml:"quality,omitempty"`
+	Lossless      bool     `yaml:"lossless,omitempty"`
 	Width         int      `yaml:"width"`
 	Height        int      `yaml:"height"`
 	MaxSize       string   `yaml:"max_size,omitempty"`
 	Interpolation string   `yaml:"interpolation,omitempty"`
+	Metadata      string   `yaml:"metadata,omitempty"`
+	Fit           string   `yaml:"fit,omitempty"`
+	Background    string   `yaml:"background,omitempty"`
+	Dither        string   `yaml:"dither,omitempty"`
+	Rotate        int      `yaml:"rotate,omitempty"`
+	Flip          string   `yaml:"flip,omitempty"`
+	Brightness    float64  `yaml:"brightness,omitempty"`
+	Contrast      float64  `yaml:"contrast,omitempty"`
+	Saturation    float64  `yaml:"saturation,omitempty"`
+	Grayscale     bool     `yaml:"grayscale,omitempty"`
+	Blur          float64  `yaml:"blur,omitempty"`
+	Sharpen       float64  `yaml:"sharpen,omitempty"`
+
+	Watermark *confWatermark `yaml:"watermark,omitempty"`
+	Caption   *confCaption   `yaml:"caption,omitempty"`
+}
+
+type confCaption struct {
+	Text       string  `yaml:"text"`
+	Size       float64 `yaml:"size,omitempty"`
+	Color      string  `yaml:"color,omitempty"`
+	Background string  `yaml:"background,omitempty"`
+	Gravity    string  `yaml:"gravity,omitempty"`
+	Margin     int     `yaml:"margin,omitempty"`
+	MaxLength  int     `yaml:"max_length,omitempty"`
+}
+
+// toCaption returns the caption of a preset. A nil caption gives the zero
+// value.
+func (c *confCaption) toCaption() (images.Caption, error) {
+	if c == nil {
+		return images.Caption{}, nil
+	}
+	errs := []error{}
+	var textColor, bg color.NRGBA
+	var err error
+	if c.Color != "" {
+		textColor, err = images.ParseColor(c.Color)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Background != "" {
+		bg, err = images.ParseColor(c.Background)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	caption := images.Caption{
+		Text:       c.Text,
+		Size:       c.Size,
+		Color:      textColor,
+		Background: bg,
+		Gravity:    images.Gravity(c.Gravity),
+		Margin:     c.Margin,
+		MaxLength:  c.MaxLength,
+	}
+	if err := caption.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return caption, errors.Join(errs...)
+}
+
+type confWatermark struct {
+	Path    string  `yaml:"path"`
+	Gravity string  `yaml:"gravity,omitempty"`
+	Margin  int     `yaml:"margin,omitempty"`
+	Opacity float64 `yaml:"opacity,omitempty"`
+	Scale   float64 `yaml:"scale,omitempty"`
+	Locked  bool    `yaml:"locked,omitempty"`
+}
+
+// toWatermark returns the watermark of a preset. A nil watermark gives the
+// zero value.
+func (c *confWatermark) toWatermark() images.Watermark {
+	if c == nil {
+		return images.Watermark{}
+	}
+	return images.Watermark{
+		Path:    c.Path,
+		Gravity: images.Gravity(c.Gravity),
+		Margin:  c.Margin,
+		Opacity: c.Opacity,
+		Scale:   c.Scale,
+		Locked:  c.Locked,
+	}
+}
+
+// filters returns the pixel adjustments of the preset.
+func (p confImagePreset) filters() images.Filters {
+	return images.Filters{
+		Brightness: p.Brightness,
+		Contrast:   p.Contrast,
+		Saturation: p.Saturation,
+		Grayscale:  p.Grayscale,
+		Blur:       p.Blur,
+		Sharpen:    p.Sharpen,
+	}
 }
 
 func saveConfig(c config, filename string) error {
@@ -85,11 +199,39 @@ func loadConfig(filename string) (config, error) {
 		return config{}, err
 	}
 
+	c.applyDefaults()
 	return c, nil
 }
 
-// validate enforces config rules and returns an error if any are broken
-func (c *config) validate() error {
+// applyDefaults sets optional values that are missing from the configuration
+// file to their defaults.
+func (c *config) applyDefaults() {
+	if c.Http.MaxUploadSize == "" {
+		c.Http.MaxUploadSize = "20MB"
+	}
+	if c.ImageDefaults.QualityWebp == 0 {
+		c.ImageDefaults.QualityWebp = 80
+	}
+	if c.ImageDefaults.Metadata == "" {
+		c.ImageDefaults.Metadata = "strip"
+	}
+	if c.ImageDefaults.Fit == "" {
+		c.ImageDefaults.Fit = "cover"
+	}
+	if c.ImageDefaults.QualityPng == 0 {
+		c.ImageDefaults.QualityPng = 6
+	}
+	if c.ImageDefaults.QualityPng8 == 0 {
+		c.ImageDefaults.QualityPng8 = 256
+	}
+	if c.ImageDefaults.Dither == "" {
+		c.ImageDefaults.Dither = "fs"
+	}
+}
+
+// validate enforces config rules and returns an error if any are broken. It
+// does not change the configuration, see applyDefaults.
+func (c config) validate() error {
 	errs := []error{}
 
 	// HTTP
@@ -97,9 +239,6 @@ func (c *config) validate() error {
 	if c.Http.Port == 0 {
 		errs = append(errs, fmt.Errorf("server port must be set"))
 	}
-	if c.Http.MaxUploadSize == "" {
-		c.Http.MaxUploadSize = "20MB"
-	}
 	_, err := size.Parse(c.Http.MaxUploadSize)
 	if err != nil {
 		errs = append(errs, fmt.Errorf("server max upload size must be a valid size (e.g. 20MB)"))
@@ -120,8 +259,8 @@ func (c *config) validate() error {
 	}
 
 	// DEFAULT IMAGE PARAMETERS
-	if c.ImageDefaults.Format != "jpeg" && c.ImageDefaults.Format != "png" && c.ImageDefaults.Format != "gif" {
-		errs = append(errs, fmt.Errorf("default image parameters format must be set to a valid value. Valid values are: jpeg, png, gif"))
+	if !validFormat(c.ImageDefaults.Format) {
+		errs = append(errs, fmt.Errorf("default image parameters format must be set to a valid value. Valid values are: jpeg, png, png8, gif, webp"))
 	}
 	if c.ImageDefaults.QualityJpeg == 0 {
 		errs = append(errs, fmt.Errorf("default image parameters quality jpeg must be set to a value greater between 1 and 100 (inclusive)"))
@@ -129,6 +268,30 @@ func (c *config) validate() error {
 	if c.ImageDefaults.QualityGif == 0 {
 		errs = append(errs, fmt.Errorf("default image parameters quality gif must be set to a value greater between 1 and 256 (inclusive)"))
 	}
+	if c.ImageDefaults.QualityWebp < 1 || c.ImageDefaults.QualityWebp > 100 {
+		errs = append(errs, fmt.Errorf("default image parameters quality webp must be set to a value between 1 and 100 (inclusive)"))
+	}
+	if c.ImageDefaults.QualityPng < 1 || c.ImageDefaults.QualityPng > 9 {
+		errs = append(errs, fmt.Errorf("default image parameters quality png (compression level) must be set to a value between 1 and 9 (inclusive)"))
+	}
+	if c.ImageDefaults.QualityPng8 < 2 || c.ImageDefaults.QualityPng8 > 256 {
+		errs = append(errs, fmt.Errorf("default image parameters quality png8 (number of colors) must be set to a value between 2 and 256 (inclusive)"))
+	}
+	if !validMetadata(c.ImageDefaults.Metadata) {
+		errs = append(errs, fmt.Errorf("default image parameters metadata must be set to a valid value. Valid values are: strip, copyright, nogps"))
+	}
+	if _, err := images.ParseFit(c.ImageDefaults.Fit); err != nil {
+		errs = append(errs, fmt.Errorf("default image parameters fit must be set to a valid value. Valid values are: cover, contain, fill, inside"))
+	}
+	if _, err := images.ParseColor(c.ImageDefaults.Background); c.ImageDefaults.Background != "" && err != nil {
+		errs = append(errs, fmt.Errorf("default image parameters background must be a hex color (e.g. fff, ffffff or ffffff00)"))
+	}
+	if _, err := images.ParseDither(c.ImageDefaults.Dither); err != nil {
+		errs = append(errs, fmt.Errorf("default image parameters dither must be set to a valid value. Valid values are: none, fs, ordered"))
+	}
+	if c.ImageDefaults.MaxDimension < 0 {
+		errs = append(errs, fmt.Errorf("default image parameters max_dimension must be 0 (no limit) or greater"))
+	}
 	if c.ImageDefaults.Width == 0 && c.ImageDefaults.Height == 0 {
 		errs = append(errs, fmt.Errorf("default image parameters width or height (or both) must be set"))
 	}
@@ -142,8 +305,8 @@ func (c *config) validate() error {
 		if name == "" {
 			errs = append(errs, fmt.Errorf("image parameters name must be set"))
 		}
-		if p.Format != "" && p.Format != "jpeg" && p.Format != "png" && p.Format != "gif" {
-			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") format must be set to a valid value. Valid values are: jpeg, png, gif", name))
+		if p.Format != "" && p.Format != "auto" && !validFormat(p.Format) {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") format must be set to a valid value. Valid values are: jpeg, png, png8, gif, webp, auto", name))
 		}
 		if p.Quality == 0 && p.Format == "jpeg" {
 			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") quality must be set to a value greater between 1 and 100 (inclusive)", name))
@@ -151,6 +314,52 @@ func (c *config) validate() error {
 		if p.Quality == 0 && p.Format == "gif" {
 			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") quality must be set to a value greater between 1 and 256 (inclusive)", name))
 		}
+		if p.Quality == 0 && p.Format == "webp" && !p.Lossless {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") quality must be set to a value between 1 and 100 (inclusive) or lossless must be set", name))
+		}
+		if p.Format == "png" && (p.Quality < 0 || p.Quality > 9) {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") quality (compression level) must be set to a value between 1 and 9 (inclusive) or 0 for the default", name))
+		}
+		if p.Format == "png8" && p.Quality != 0 && (p.Quality < 2 || p.Quality > 256) {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") quality (number of colors) must be set to a value between 2 and 256 (inclusive) or 0 for the default", name))
+		}
+		if p.Lossless && p.Format != "webp" {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") lossless can only be set for format webp", name))
+		}
+		if p.Metadata != "" && !validMetadata(p.Metadata) {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") metadata must be set to a valid value. Valid values are: strip, copyright, nogps", name))
+		}
+		if _, err := images.ParseFit(p.Fit); p.Fit != "" && err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") fit must be set to a valid value. Valid values are: cover, contain, fill, inside", name))
+		}
+		if _, err := images.ParseColor(p.Background); p.Background != "" && p.Background != images.BackgroundDominant && err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") background must be a hex color (e.g. fff, ffffff or ffffff00) or dominant", name))
+		}
+		if _, err := images.ParseDither(p.Dither); p.Dither != "" && err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") dither must be set to a valid value. Valid values are: none, fs, ordered", name))
+		}
+		if _, err := images.ParseRotation(strconv.Itoa(p.Rotate)); err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") rotate must be set to a valid value. Valid values are: 0, 90, 180, 270", name))
+		}
+		if _, err := images.ParseFlip(p.Flip); p.Flip != "" && err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") flip must be set to a valid value. Valid values are: h, v, hv", name))
+		}
+		if err := p.filters().Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") filters are out of range: %w", name, err))
+		}
+		if p.Watermark != nil {
+			if p.Watermark.Path == "" {
+				errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") watermark path must be set", name))
+			} else if _, err := os.Stat(p.Watermark.Path); err != nil {
+				errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") watermark could not be read: %w", name, err))
+			}
+			if err := p.Watermark.toWatermark().Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") watermark is not valid: %w", name, err))
+			}
+		}
+		if _, err := p.Caption.toCaption(); err != nil {
+			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") caption is not valid: %w", name, err))
+		}
 		if p.Width == 0 && p.Height == 0 {
 			errs = append(errs, fmt.Errorf("image parameters (name: \"%s\") width or height (or both) must be set", name))
 		}
@@ -169,6 +378,24 @@ func (c *config) validate() error {
 	return nil
 }
 
+// validFormat reports whether s is a format that can be used in the configuration.
+func validFormat(s string) bool {
+	switch s {
+	case "jpeg", "png", "png8", "gif", "webp":
+		return true
+	}
+	return false
+}
+
+// validMetadata reports whether s is a metadata policy that can be used in the configuration.
+func validMetadata(s string) bool {
+	switch s {
+	case "strip", "copyright", "nogps":
+		return true
+	}
+	return false
+}
+
 // TODO: handle errors by returning them?
 func toImageDefaults(c confImageDefault) (images.ImageDefaults, error) {
 	errs := []error{}
@@ -187,6 +414,32 @@ func toImageDefaults(c confImageDefault) (images.ImageDefaults, error) {
 		errs = append(errs, err)
 	}
 
+	metadata, err := images.ParseMetadata(c.Metadata)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	fit, err := images.ParseFit(c.Fit)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	var bg color.NRGBA
+	if c.Background != "" {
+		bg, err = images.ParseColor(c.Background)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	dither := images.DitherFloydSteinberg
+	if c.Dither != "" {
+		dither, err = images.ParseDither(c.Dither)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if len(errs) > 0 {
 		newErrs := []error{fmt.Errorf("(%d) errors while building ImageDefaults", len(errs))}
 		newErrs = append(newErrs, errs...)
@@ -197,10 +450,20 @@ func toImageDefaults(c confImageDefault) (images.ImageDefaults, error) {
 		Format:        format,
 		QualityJpeg:   c.QualityJpeg,
 		QualityGif:    c.QualityGif,
+		QualityWebp:   c.QualityWebp,
+		QualityPng:    c.QualityPng,
+		QualityPng8:   c.QualityPng8,
 		Width:         c.Width,
 		Height:        c.Height,
 		MaxSize:       size,
 		Interpolation: interpolation,
+		Metadata:      metadata,
+		Fit:           fit,
+		Background:    bg,
+		Dither:        dither,
+
+		MaxDimension:   c.MaxDimension,
+		DprCapOriginal: c.DprCapOriginal,
 	}, nil
 }
 
@@ -243,16 +506,87 @@ func toImagePresets(conf []confImagePreset, def images.ImageDefaults) ([]images.
 			interpolation = def.Interpolation
 		}
 
+		// metadata
+		var metadata images.Metadata
+		if cip.Metadata != "" {
+			metadata, err = images.ParseMetadata(cip.Metadata)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		} else {
+			metadata = def.Metadata
+		}
+
+		// fit
+		fit := def.Fit
+		if cip.Fit != "" {
+			fit, err = images.ParseFit(cip.Fit)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		// background
+		bg := def.Background
+		dominantBg := cip.Background == images.BackgroundDominant
+		if cip.Background != "" && !dominantBg {
+			bg, err = images.ParseColor(cip.Background)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		// dither
+		dither := def.Dither
+		if cip.Dither != "" {
+			dither, err = images.ParseDither(cip.Dither)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		// rotate and flip
+		rot, err := images.ParseRotation(strconv.Itoa(cip.Rotate))
+		if err != nil {
+			errs = append(errs, err)
+		}
+		flip := images.FlipNone
+		if cip.Flip != "" {
+			flip, err = images.ParseFlip(cip.Flip)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		// caption
+		caption, err := cip.Caption.toCaption()
+		if err != nil {
+			errs = append(errs, err)
+		}
+
 		// resulting preset
 		p := images.ImagePreset{
 			Name:          cip.Name,
 			Alias:         cip.Alias,
 			Format:        format,
 			Quality:       cip.Quality,
+			Lossless:      cip.Lossless,
 			Width:         cip.Width,
 			Height:        cip.Height,
 			MaxSize:       s,
 			Interpolation: interpolation,
+			Metadata:      metadata,
+			Fit:           fit,
+			Background:    bg,
+			Dither:        dither,
+			Rotate:        rot,
+			Flip:          flip,
+			Filters:       cip.filters(),
+			Watermark:     cip.Watermark.toWatermark(),
+			Caption:       caption,
+
+			BackgroundSet:      cip.Background != "" && !dominantBg,
+			DominantBackground: dominantBg,
 		}
 		presets = append(presets, p)
 	}
@@ -289,10 +623,16 @@ func defaultConfig() config {
 			Format:        "jpeg",
 			QualityJpeg:   80,
 			QualityGif:    256,
+			QualityWebp:   80,
+			QualityPng:    6,
+			QualityPng8:   256,
 			Width:         0,
 			Height:        800,
 			MaxSize:       "1 MB",
 			Interpolation: "nearestNeighbor",
+			Metadata:      "strip",
+			Fit:           "cover",
+			Dither:        "fs",
 		},
 		ImagePresets: []confImagePreset{
 			{
@@ -0,0 +1,146 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+// loadGif returns all frames of the gif at path.
+func loadGif(path string) (*gif.GIF, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return gif.DecodeAll(file)
+}
+
+// gifCanvas returns the logical screen of anim.
+func gifCanvas(anim *gif.GIF) image.Rectangle {
+	canvas := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if canvas.Empty() {
+		for _, frame := range anim.Image {
+			canvas = canvas.Union(frame.Rect)
+		}
+	}
+	return canvas
+}
+
+// gifFrame returns frame n (1 is the first frame) of anim as it is displayed,
+// with the frames before it and their disposal methods applied. n is clamped
+// to the number of frames.
+func gifFrame(anim *gif.GIF, n uint) image.Image {
+	if n < 1 {
+		n = 1
+	}
+	if int(n) > len(anim.Image) {
+		n = uint(len(anim.Image))
+	}
+
+	canvas := image.NewRGBA(gifCanvas(anim))
+	var previous *image.RGBA
+	for i, frame := range anim.Image[:n] {
+		disposal := byte(gif.DisposalNone)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		if i == int(n)-1 {
+			break
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+	return canvas
+}
+
+// resizeGif returns anim with every frame cropped to crop and scaled to
+// width x height. A width or height of 0 keeps the aspect ratio of crop.
+// Delays, disposal methods and loop count are kept. Every frame is mapped
+// back to its own palette without dithering to avoid flicker.
+func resizeGif(anim *gif.GIF, crop image.Rectangle, width, height uint, interp resize.InterpolationFunction) *gif.GIF {
+	cw, ch := float64(crop.Dx()), float64(crop.Dy())
+	tw, th := float64(width), float64(height)
+	switch {
+	case width == 0 && height == 0:
+		tw, th = cw, ch
+	case width == 0:
+		tw = math.Max(1, math.Round(th*cw/ch))
+	case height == 0:
+		th = math.Max(1, math.Round(tw*ch/cw))
+	}
+	sx, sy := tw/cw, th/ch
+	bounds := image.Rect(0, 0, int(tw), int(th))
+
+	out := &gif.GIF{
+		Image:           make([]*image.Paletted, 0, len(anim.Image)),
+		Delay:           anim.Delay,
+		Disposal:        anim.Disposal,
+		LoopCount:       anim.LoopCount,
+		BackgroundIndex: anim.BackgroundIndex,
+		Config: image.Config{
+			ColorModel: anim.Config.ColorModel,
+			Width:      bounds.Dx(),
+			Height:     bounds.Dy(),
+		},
+	}
+
+	for _, frame := range anim.Image {
+		r := frame.Rect.Intersect(crop)
+		if r.Empty() {
+			// the frame is needed to keep its delay, but has nothing to show
+			out.Image = append(out.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Transparent}))
+			continue
+		}
+
+		dst := image.Rect(
+			int(math.Floor(float64(r.Min.X-crop.Min.X)*sx)),
+			int(math.Floor(float64(r.Min.Y-crop.Min.Y)*sy)),
+			int(math.Ceil(float64(r.Max.X-crop.Min.X)*sx)),
+			int(math.Ceil(float64(r.Max.Y-crop.Min.Y)*sy)),
+		).Intersect(bounds)
+		if dst.Empty() {
+			dst = image.Rectangle{Min: dst.Min, Max: dst.Min.Add(image.Pt(1, 1))}.Intersect(bounds)
+		}
+
+		scaled := resize.Resize(uint(dst.Dx()), uint(dst.Dy()), frame.SubImage(r), interp)
+		paletted := image.NewPaletted(dst, frame.Palette)
+		draw.Draw(paletted, dst, scaled, scaled.Bounds().Min, draw.Src)
+		out.Image = append(out.Image, paletted)
+	}
+	return out
+}
+
+// ErrInvalidFrame is returned when a frame is requested from an original that
+// is not a gif.
+type ErrInvalidFrame struct {
+	Frame  uint
+	Format Format
+}
+
+func (e ErrInvalidFrame) Error() string {
+	return fmt.Sprintf("invalid frame. \n\tGot: frame %d of a %s\n\tWant: frames of gif originals only", e.Frame, e.Format)
+}
+
+func (e ErrInvalidFrame) Is(err error) bool {
+	_, ok := err.(ErrInvalidFrame)
+	return ok
+}
@@ -0,0 +1,194 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// font size used when none is set
+	captionDefaultSize = 24
+	// smallest font size a caption is shrunk to when it does not fit
+	captionMinSize = 6
+)
+
+// Caption is a line of text drawn onto created images. The zero value means
+// no caption.
+type Caption struct {
+	Text string
+	// font size in pixels (0 = 24). Captions wider than the image are shrunk
+	// to fit.
+	Size float64
+	// color of the text (zero value = white)
+	Color color.NRGBA
+	// box drawn behind the text (zero value = no box)
+	Background color.NRGBA
+	// where the caption is placed (zero value = south)
+	Gravity Gravity
+	// distance to the edges in pixels
+	Margin int
+	// maximum length of a text set through the url (0 = the text can not be
+	// changed through the url)
+	MaxLength int
+}
+
+// IsZero reports whether no caption is set.
+func (c Caption) IsZero() bool {
+	return c.Text == ""
+}
+
+// Validate returns an error if the caption settings are out of range.
+func (c Caption) Validate() error {
+	if c.Gravity != "" {
+		if _, err := ParseGravity(string(c.Gravity)); err != nil {
+			return err
+		}
+	}
+	if c.Size < 0 || math.IsNaN(c.Size) || math.IsInf(c.Size, 0) {
+		return fmt.Errorf("invalid caption size. \n\tGot: '%g'\n\tWant: 0 or greater", c.Size)
+	}
+	if c.Margin < 0 {
+		return fmt.Errorf("invalid caption margin. \n\tGot: '%d'\n\tWant: 0 or greater", c.Margin)
+	}
+	if c.MaxLength < 0 {
+		return fmt.Errorf("invalid caption max length. \n\tGot: '%d'\n\tWant: 0 or greater", c.MaxLength)
+	}
+	return nil
+}
+
+// SetText replaces the text of the caption with text given through the url.
+// The text can not be empty, as that would remove the caption.
+func (c *Caption) SetText(text string) error {
+	if c.MaxLength == 0 {
+		return fmt.Errorf("text can not be set for this image")
+	}
+	if text == "" {
+		return fmt.Errorf("text can not be empty")
+	}
+	if n := utf8.RuneCountInString(text); n > c.MaxLength {
+		return fmt.Errorf("text is too long. \n\tGot: %d characters\n\tWant: at most %d", n, c.MaxLength)
+	}
+	c.Text = text
+	return nil
+}
+
+// key returns a hash of the caption as part of a file name. The text may be
+// chosen by clients, so the hash must not collide for different texts.
+func (c Caption) key() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%q|%g|%v|%v|%s|%d", c.Text, c.Size, c.Color, c.Background, c.Gravity, c.Margin)
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+var (
+	captionFontOnce sync.Once
+	captionFont     *opentype.Font
+	captionFontErr  error
+)
+
+// captionFace returns the embedded font at the given size in pixels.
+func captionFace(size float64) (font.Face, error) {
+	captionFontOnce.Do(func() {
+		captionFont, captionFontErr = opentype.Parse(goregular.TTF)
+	})
+	if captionFontErr != nil {
+		return nil, captionFontErr
+	}
+	return opentype.NewFace(captionFont, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72, // one point per pixel
+		Hinting: font.HintingFull,
+	})
+}
+
+// renderCaption returns the caption drawn onto a transparent image and where
+// it is placed within bounds.
+func renderCaption(c Caption, bounds image.Rectangle) (image.Image, image.Rectangle, error) {
+	size := c.Size
+	if size == 0 {
+		size = captionDefaultSize
+	}
+	face, err := captionFace(size)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+
+	// shrink the text until it fits
+	maxWidth := bounds.Dx() - 2*c.Margin
+	for {
+		width := font.MeasureString(face, c.Text).Ceil() + int(size/2)
+		if width <= maxWidth || size <= captionMinSize {
+			break
+		}
+		face.Close()
+		size = math.Max(captionMinSize, math.Floor(size*float64(maxWidth)/float64(width)))
+		face, err = captionFace(size)
+		if err != nil {
+			return nil, image.Rectangle{}, err
+		}
+	}
+	defer face.Close()
+
+	// the box is padded by a quarter of the font size
+	pad := int(math.Ceil(size / 4))
+	metrics := face.Metrics()
+	textWidth := font.MeasureString(face, c.Text).Ceil()
+	boxSize := image.Pt(textWidth+2*pad, (metrics.Ascent+metrics.Descent).Ceil()+2*pad)
+
+	gravity := c.Gravity
+	if gravity == "" {
+		gravity = GravitySouth
+	}
+	r := placeRect(bounds, boxSize, gravity, c.Margin)
+
+	textColor := c.Color
+	if textColor == (color.NRGBA{}) {
+		textColor = color.NRGBA{255, 255, 255, 255}
+	}
+	overlay := image.NewRGBA(image.Rectangle{Max: boxSize})
+	draw.Draw(overlay, overlay.Rect, image.NewUniform(c.Background), image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  overlay,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+		Dot:  fixed.P(pad, pad+metrics.Ascent.Ceil()),
+	}
+	d.DrawString(c.Text)
+	return overlay, r, nil
+}
+
+// applyCaption returns a copy of img with the caption drawn onto it.
+func applyCaption(img image.Image, c Caption) (image.Image, error) {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+
+	overlay, r, err := renderCaption(c, dst.Rect)
+	if err != nil {
+		return nil, err
+	}
+	draw.Draw(dst, r, overlay, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+// captionGif returns anim with the caption drawn onto every frame.
+func captionGif(anim *gif.GIF, c Caption) (*gif.GIF, error) {
+	overlay, r, err := renderCaption(c, gifCanvas(anim))
+	if err != nil {
+		return nil, err
+	}
+	return overlayGif(anim, overlay, r, nil), nil
+}
@@ -0,0 +1,122 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+func TestCaption_SetText(t *testing.T) {
+	t.Parallel()
+	c := Caption{Text: "SAMPLE", MaxLength: 5}
+	if err := c.SetText("© Jo"); err != nil || c.Text != "© Jo" {
+		t.Errorf("SetText() = %v, text %q", err, c.Text)
+	}
+	if err := c.SetText("too long"); err == nil {
+		t.Error("SetText() expected an error for a text longer than MaxLength")
+	}
+	if err := c.SetText(""); err == nil || c.Text != "© Jo" {
+		t.Errorf("SetText(\"\") = %v, text %q, want an error and the text kept", err, c.Text)
+	}
+
+	locked := Caption{Text: "SAMPLE"}
+	if err := locked.SetText("clean"); err == nil || locked.Text != "SAMPLE" {
+		t.Errorf("SetText() on a caption without MaxLength = %v, text %q", err, locked.Text)
+	}
+}
+
+func TestCaption_key(t *testing.T) {
+	t.Parallel()
+	a, b := Caption{Text: "SAMPLE"}, Caption{Text: "SAMPLE", Size: 12}
+	if len(a.key()) != 32 {
+		t.Errorf("key() = %q, want 32 hex characters", a.key())
+	}
+	if a.key() == b.key() || a.key() == (Caption{Text: "SAMPLe"}).key() {
+		t.Error("key() is the same for different captions")
+	}
+	if a.key() != (Caption{Text: "SAMPLE"}).key() {
+		t.Error("key() differs for the same caption")
+	}
+}
+
+func Test_renderCaption(t *testing.T) {
+	t.Parallel()
+	bounds := image.Rect(0, 0, 400, 200)
+
+	overlay, r, err := renderCaption(Caption{Text: "SAMPLE", Size: 20, Margin: 10}, bounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overlay.Bounds().Size() != r.Size() {
+		t.Errorf("renderCaption() overlay size %v, placed at %v", overlay.Bounds().Size(), r)
+	}
+	// south by default
+	if r.Max.Y != 190 || r.Min.X+r.Max.X != 400 {
+		t.Errorf("renderCaption() placed at %v, want bottom center", r)
+	}
+	if r.Dy() < 20 || r.Dx() < 40 {
+		t.Errorf("renderCaption() size %v is too small for the text", r.Size())
+	}
+
+	// long texts are shrunk to fit
+	_, r, err = renderCaption(Caption{Text: "copyright line", Size: 40}, image.Rect(0, 0, 100, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Dx() > 100 || r.Dy() >= 40 {
+		t.Errorf("renderCaption() size %v, want it shrunk to fit 100 pixels", r.Size())
+	}
+}
+
+func Test_applyCaption(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+
+	c := Caption{Text: "x", Gravity: GravityNorthWest, Color: color.NRGBA{255, 0, 0, 255}, Background: color.NRGBA{0, 0, 0, 255}}
+	got, err := applyCaption(img, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the corner is covered by the padding of the box
+	if c := color.NRGBAModel.Convert(got.At(1, 1)); c != (color.NRGBA{0, 0, 0, 255}) {
+		t.Errorf("applyCaption() at (1, 1) = %v, want the background of the box", c)
+	}
+	foundText := false
+	for y := 0; y < 40 && !foundText; y++ {
+		for x := 0; x < 40; x++ {
+			if r, _, _, _ := got.At(x, y).RGBA(); r > 0x8000 {
+				foundText = true
+				break
+			}
+		}
+	}
+	if !foundText {
+		t.Error("applyCaption() drew no text")
+	}
+	if c := color.NRGBAModel.Convert(got.At(199, 99)); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("applyCaption() at (199, 99) = %v, want white", c)
+	}
+}
+
+func Test_captionGif(t *testing.T) {
+	t.Parallel()
+	palette := color.Palette{color.White, color.Black}
+	anim := &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 100, 50), palette), image.NewPaletted(image.Rect(0, 0, 100, 50), palette)},
+		Delay:  []int{1, 2},
+		Config: image.Config{Width: 100, Height: 50},
+	}
+
+	got, err := captionGif(anim, Caption{Text: "hi", Gravity: GravityNorthWest, Background: color.NRGBA{0, 0, 0, 255}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range got.Image {
+		if frame.ColorIndexAt(1, 1) != 1 {
+			t.Errorf("captionGif() frame %d has no box in the corner", i)
+		}
+	}
+}
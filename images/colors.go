@@ -0,0 +1,138 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// number of colors in a palette when none is requested
+	DefaultPaletteSize = 5
+	// largest number of colors in a palette
+	MaxPaletteSize = 16
+	// width and height colors are extracted from
+	colorsSampleSize = 100
+)
+
+// BackgroundDominant is given in place of a background color to pad images
+// with their dominant color.
+const BackgroundDominant = "dominant"
+
+// Colors are the colors an image is made of.
+type Colors struct {
+	// hex color covering the largest part of the image
+	Dominant string `json:"dominant"`
+	// most common colors, largest population first
+	Palette []PaletteColor `json:"palette"`
+}
+
+// PaletteColor is a color of an image and how much of the image it covers.
+type PaletteColor struct {
+	// hex color, e.g. "#a1b2c3"
+	Color string `json:"color"`
+	// part of the opaque pixels in percent
+	Population float64 `json:"population"`
+}
+
+// Colors returns the dominant color and a palette of n colors of the image
+// with the given id. They are computed once for each n and stored with the
+// original.
+func (h *ImageHandler) Colors(id int, n int) (Colors, error) {
+	if n < 1 || n > MaxPaletteSize {
+		return Colors{}, ErrInvalidPaletteSize{Size: n}
+	}
+	_, err := h.originalPath(id)
+	if err != nil {
+		return Colors{}, err
+	}
+	sc, err := h.readSidecar(id)
+	if err != nil {
+		return Colors{}, err
+	}
+	if c, ok := sc.Colors[n]; ok {
+		return c, nil
+	}
+
+	img, err := h.loadOriginal(id)
+	if err != nil {
+		return Colors{}, err
+	}
+	c := extractColors(img, n)
+	err = h.updateSidecar(id, func(sc *sidecar) {
+		// copied as the stored map may be read without the lock
+		colors := make(map[int]Colors, len(sc.Colors)+1)
+		for k, v := range sc.Colors {
+			colors[k] = v
+		}
+		colors[n] = c
+		sc.Colors = colors
+	})
+	if err != nil {
+		return Colors{}, fmt.Errorf("could not store colors: %w", err)
+	}
+	return c, nil
+}
+
+// dominantColor returns the dominant color of the image with the given id,
+// as found in its default palette. ok is false for images without opaque
+// pixels.
+func (h *ImageHandler) dominantColor(id int) (c color.NRGBA, ok bool, err error) {
+	colors, err := h.Colors(id, DefaultPaletteSize)
+	if err != nil || colors.Dominant == "" {
+		return color.NRGBA{}, false, err
+	}
+	c, err = ParseColor(colors.Dominant)
+	return c, err == nil, err
+}
+
+// extractColors returns the n most common colors of img. Transparent pixels
+// are ignored.
+func extractColors(img image.Image, n int) Colors {
+	sample := resize.Thumbnail(colorsSampleSize, colorsSampleSize, img, resize.Bilinear)
+
+	opaque := []*histogramBin{}
+	var total uint64
+	for _, bin := range colorHistogram(sample) {
+		if bin.mean[3] >= 128 {
+			opaque = append(opaque, bin)
+			total += bin.count
+		}
+	}
+	if total == 0 {
+		return Colors{Palette: []PaletteColor{}}
+	}
+
+	boxes := medianCutBoxes(opaque, n)
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return boxes[i].count > boxes[j].count
+	})
+	palette := make([]PaletteColor, len(boxes))
+	for i, box := range boxes {
+		c := box.color()
+		palette[i] = PaletteColor{
+			Color:      fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+			Population: math.Round(float64(box.count)/float64(total)*1000) / 10,
+		}
+	}
+	return Colors{Dominant: palette[0].Color, Palette: palette}
+}
+
+// ErrInvalidPaletteSize is returned when a palette of an unsupported number
+// of colors is requested.
+type ErrInvalidPaletteSize struct {
+	Size int
+}
+
+func (e ErrInvalidPaletteSize) Error() string {
+	return fmt.Sprintf("invalid palette size. \n\tGot: '%d'\n\tWant: 1 to %d (inclusive)", e.Size, MaxPaletteSize)
+}
+
+func (e ErrInvalidPaletteSize) Is(err error) bool {
+	_, ok := err.(ErrInvalidPaletteSize)
+	return ok
+}
@@ -0,0 +1,40 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func Test_extractColors(t *testing.T) {
+	t.Parallel()
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(img, image.Rect(0, 0, 100, 60), image.NewUniform(color.NRGBA{0, 128, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 60, 100, 80), image.NewUniform(color.NRGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+	// bottom fifth is left transparent
+
+	got := extractColors(img, 2)
+	if got.Dominant != "#008000" {
+		t.Errorf("extractColors() dominant = %s, want #008000", got.Dominant)
+	}
+	want := []PaletteColor{{"#008000", 75}, {"#ffffff", 25}}
+	if len(got.Palette) != len(want) {
+		t.Fatalf("extractColors() palette = %+v, want %+v", got.Palette, want)
+	}
+	for i := range want {
+		if got.Palette[i] != want[i] {
+			t.Errorf("extractColors() palette[%d] = %+v, want %+v", i, got.Palette[i], want[i])
+		}
+	}
+
+	// fewer colors than asked for
+	if got := extractColors(img, 16); len(got.Palette) > 3 {
+		t.Errorf("extractColors() palette = %+v, want at most the colors of the image", got.Palette)
+	}
+
+	clear := extractColors(image.NewNRGBA(image.Rect(0, 0, 10, 10)), 5)
+	if clear.Dominant != "" || len(clear.Palette) != 0 {
+		t.Errorf("extractColors() of a transparent image = %+v, want no colors", clear)
+	}
+}
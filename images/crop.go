@@ -0,0 +1,138 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Crop is a region of the original that is cut out before the image is
+// resized. Values are pixels, or percentages of the width and height of the
+// original if Percent is set. Coordinates refer to the upright original,
+// after its exif orientation has been applied.
+type Crop struct {
+	X, Y, W, H float64
+	Percent    bool
+}
+
+// ParseCrop parses a crop given as "x,y,w,h". Either all values are pixels
+// or all values are percentages, e.g. "10%,10%,50%,50%".
+func ParseCrop(s string) (Crop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Crop{}, fmt.Errorf("invalid crop. \n\tGot: '%s'\n\tWant: 'x,y,w,h' in pixels or percentages (e.g. '10,10,200,100' or '10%%,10%%,50%%,50%%')", s)
+	}
+
+	c := Crop{Percent: strings.HasSuffix(strings.TrimSpace(parts[0]), "%")}
+	vals := make([]float64, 4)
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		num, isPercent := strings.CutSuffix(p, "%")
+		if isPercent != c.Percent {
+			return Crop{}, fmt.Errorf("invalid crop '%s': pixels and percentages can not be mixed", s)
+		}
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) {
+			return Crop{}, fmt.Errorf("invalid crop '%s': '%s' is not a positive number", s, p)
+		}
+		if !c.Percent && v != math.Trunc(v) {
+			return Crop{}, fmt.Errorf("invalid crop '%s': pixels must be whole numbers", s)
+		}
+		vals[i] = v
+	}
+	c.X, c.Y, c.W, c.H = vals[0], vals[1], vals[2], vals[3]
+	if c.W == 0 || c.H == 0 {
+		return Crop{}, fmt.Errorf("invalid crop '%s': width and height must be greater than 0", s)
+	}
+	return c, nil
+}
+
+// IsZero reports whether no crop is set.
+func (c Crop) IsZero() bool {
+	return c == Crop{}
+}
+
+// String returns the crop in the format accepted by ParseCrop.
+func (c Crop) String() string {
+	unit := ""
+	if c.Percent {
+		unit = "%"
+	}
+	return fmt.Sprintf("%g%s,%g%s,%g%s,%g%s", c.X, unit, c.Y, unit, c.W, unit, c.H, unit)
+}
+
+// key returns the crop as part of a file name.
+func (c Crop) key() string {
+	unit := ""
+	if c.Percent {
+		unit = "p"
+	}
+	return fmt.Sprintf("%g%s-%g%s-%g%s-%g%s", c.X, unit, c.Y, unit, c.W, unit, c.H, unit)
+}
+
+// rect returns the crop in pixels within bounds. ErrInvalidCrop is returned
+// if the crop is not fully within bounds.
+func (c Crop) rect(bounds image.Rectangle) (image.Rectangle, error) {
+	x, y, w, h := c.X, c.Y, c.W, c.H
+	if c.Percent {
+		dx, dy := float64(bounds.Dx())/100, float64(bounds.Dy())/100
+		x, y, w, h = x*dx, y*dy, w*dx, h*dy
+	}
+	r := image.Rect(
+		int(math.Round(x)),
+		int(math.Round(y)),
+		int(math.Round(x+w)),
+		int(math.Round(y+h)),
+	).Add(bounds.Min)
+
+	if r.Empty() || !r.In(bounds) {
+		return image.Rectangle{}, ErrInvalidCrop{Crop: c, Bounds: bounds.Size()}
+	}
+	return r, nil
+}
+
+// cropImage cuts c out of img. The focal point of img is returned relative
+// to the cropped image.
+func cropImage(img image.Image, c Crop, focus FocalPoint) (image.Image, FocalPoint, error) {
+	b := img.Bounds()
+	r, err := c.rect(b)
+	if err != nil {
+		return nil, focus, err
+	}
+	focus = focus.within(b, r)
+	if sub, ok := img.(SubImager); ok {
+		return sub.SubImage(r), focus, nil
+	}
+	dst := image.NewNRGBA(r)
+	draw.Draw(dst, r, img, r.Min, draw.Src)
+	return dst, focus, nil
+}
+
+// within returns the focal point relative to r, a part of bounds. It is
+// clamped to r.
+func (fp FocalPoint) within(bounds, r image.Rectangle) FocalPoint {
+	x := (fp.X*float64(bounds.Dx()) - float64(r.Min.X-bounds.Min.X)) / float64(r.Dx())
+	y := (fp.Y*float64(bounds.Dy()) - float64(r.Min.Y-bounds.Min.Y)) / float64(r.Dy())
+	return FocalPoint{
+		X: math.Max(0, math.Min(1, x)),
+		Y: math.Max(0, math.Min(1, y)),
+	}
+}
+
+// ErrInvalidCrop is returned when a crop is not within the original.
+type ErrInvalidCrop struct {
+	Crop   Crop
+	Bounds image.Point
+}
+
+func (e ErrInvalidCrop) Error() string {
+	return fmt.Sprintf("crop (%s) is not within the image (%dx%d)", e.Crop, e.Bounds.X, e.Bounds.Y)
+}
+
+func (e ErrInvalidCrop) Is(err error) bool {
+	_, ok := err.(ErrInvalidCrop)
+	return ok
+}
@@ -0,0 +1,129 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// loadHashes indexes the content hashes of all originals. Originals added
+// before hashes were recorded are hashed as stored.
+func (h *ImageHandler) loadHashes() error {
+	ids, err := h.Ids()
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]int, len(ids))
+	for _, id := range ids {
+		sc, err := h.readSidecar(id)
+		if err != nil {
+			return fmt.Errorf("could not read sidecar of id %d: %w", id, err)
+		}
+		sum := sc.Sha256
+		if sum == "" {
+			path, err := h.originalPath(id)
+			if err != nil {
+				return err
+			}
+			sum, err = hashFile(path)
+			if err != nil {
+				return fmt.Errorf("could not hash original %d: %w", id, err)
+			}
+			err = h.updateSidecar(id, func(sc *sidecar) { sc.Sha256 = sum })
+			if err != nil {
+				return fmt.Errorf("could not store hash of id %d: %w", id, err)
+			}
+		}
+		// the lowest id is kept when originals are already duplicated
+		if _, ok := hashes[sum]; !ok {
+			hashes[sum] = id
+		}
+	}
+
+	h.mu.Lock()
+	h.hashes = hashes
+	h.mu.Unlock()
+	return nil
+}
+
+// newId returns the id of a new original with the given hash. The hash is
+// reserved for the id in the same step unless another original has it. With
+// dedupe enabled the id of an identical original is returned together with
+// ErrDuplicate instead. Identical uploads that are not stored yet are waited
+// for, as they might fail. releaseHash must be called once the new original
+// is stored or failed.
+func (h *ImageHandler) newId(sum string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for h.opts.dedupe {
+		dup, ok := h.hashes[sum]
+		if !ok {
+			break
+		}
+		done, pending := h.pending[dup]
+		if !pending {
+			return dup, ErrDuplicate{Id: dup}
+		}
+		h.mu.Unlock()
+		<-done
+		h.mu.Lock()
+	}
+
+	h.latestId++
+	id := h.latestId
+	if _, ok := h.hashes[sum]; !ok {
+		h.hashes[sum] = id
+		h.pending[id] = make(chan struct{})
+	}
+	return id, nil
+}
+
+// releaseHash ends the reservation of a hash made by newId. The hash is
+// dropped if the original was not stored.
+func (h *ImageHandler) releaseHash(sum string, id int, stored bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	done, ok := h.pending[id]
+	if !ok {
+		return
+	}
+	delete(h.pending, id)
+	close(done)
+	if !stored && h.hashes[sum] == id {
+		delete(h.hashes, sum)
+	}
+}
+
+// hashFile returns the hex encoded SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ErrDuplicate is returned by Add, together with the id of the stored
+// original, when an identical file has already been added.
+type ErrDuplicate struct {
+	Id int
+}
+
+func (e ErrDuplicate) Error() string {
+	return fmt.Sprintf("image is a duplicate of id (%d)", e.Id)
+}
+
+func (e ErrDuplicate) Is(err error) bool {
+	_, ok := err.(ErrDuplicate)
+	return ok
+}
@@ -0,0 +1,88 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// maxDpr is the highest device pixel ratio accepted.
+const maxDpr = 4
+
+// ParseDpr parses a device pixel ratio between 1 and 4, e.g. "2" or "1.5".
+func ParseDpr(s string) (float64, error) {
+	dpr, err := strconv.ParseFloat(s, 64)
+	if err != nil || dpr < 1 || dpr > maxDpr {
+		return 0, fmt.Errorf("invalid dpr. \n\tGot: '%s'\n\tWant: 1 to %d (inclusive), e.g. '2' or '1.5'", s, maxDpr)
+	}
+	return dpr, nil
+}
+
+// applyDpr multiplies the requested width and height by the device pixel
+// ratio of params. If the defaults say so the ratio is lowered to not scale
+// past the original, or the part of it that is cropped, but never below 1.
+func (h *ImageHandler) applyDpr(params *ImageParameters) error {
+	dpr := params.Dpr
+	if dpr <= 1 || (params.Width == 0 && params.Height == 0) {
+		return nil
+	}
+
+	if h.opts.imageDefaults.DprCapOriginal {
+		size, err := h.sourceSize(*params)
+		if err != nil {
+			return err
+		}
+		if params.Width != 0 {
+			dpr = math.Min(dpr, float64(size.X)/float64(params.Width))
+		}
+		if params.Height != 0 {
+			dpr = math.Min(dpr, float64(size.Y)/float64(params.Height))
+		}
+		dpr = math.Max(1, dpr)
+	}
+
+	params.Width = uint(math.Round(float64(params.Width) * dpr))
+	params.Height = uint(math.Round(float64(params.Height) * dpr))
+	return nil
+}
+
+// capDimensions returns width and height scaled down to not exceed max. The
+// ratio is kept if both are set. A max of 0 means no limit.
+func capDimensions(width, height, max uint) (uint, uint) {
+	if max == 0 || (width <= max && height <= max) {
+		return width, height
+	}
+	s := float64(max) / float64(width)
+	if height > width {
+		s = float64(max) / float64(height)
+	}
+	scale := func(v uint) uint {
+		if v == 0 {
+			return 0
+		}
+		return uint(math.Max(1, math.Round(float64(v)*s)))
+	}
+	return scale(width), scale(height)
+}
+
+// sourceSize returns the size of the part of the original an image is
+// created from: upright, cropped and rotated as set in params.
+func (h *ImageHandler) sourceSize(params ImageParameters) (image.Point, error) {
+	info, err := h.Info(params.Id)
+	if err != nil {
+		return image.Point{}, err
+	}
+	size := image.Pt(info.Width, info.Height)
+	if !params.Crop.IsZero() {
+		r, err := params.Crop.rect(image.Rectangle{Max: size})
+		if err != nil {
+			return image.Point{}, err
+		}
+		size = r.Size()
+	}
+	if transformOrientation(params.Rotate, params.Flip) >= orientTranspose {
+		size = image.Pt(size.Y, size.X)
+	}
+	return size, nil
+}
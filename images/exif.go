@@ -0,0 +1,332 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Only the parts of exif needed by this package are implemented. Exif data
+// is a TIFF structure embedded in the image file:
+//   - jpeg: APP1 segment starting with "Exif\x00\x00"
+//   - png:  eXIf chunk
+//   - webp: EXIF chunk
+
+const (
+	tagMake        uint16 = 0x010f
+	tagModel       uint16 = 0x0110
+	tagOrientation uint16 = 0x0112
+	tagSoftware    uint16 = 0x0131
+	tagArtist      uint16 = 0x013b
+	tagSubIFDs     uint16 = 0x014a
+	tagCopyright   uint16 = 0x8298
+	tagExifIFD     uint16 = 0x8769
+	tagGpsIFD      uint16 = 0x8825
+
+	// exif IFD
+	tagExposureTime     uint16 = 0x829a
+	tagFNumber          uint16 = 0x829d
+	tagIso              uint16 = 0x8827
+	tagDateTimeOriginal uint16 = 0x9003
+	tagFocalLength      uint16 = 0x920a
+	tagMakerNote        uint16 = 0x927c
+	tagPixelXDimension  uint16 = 0xa002
+	tagPixelYDimension  uint16 = 0xa003
+	tagInteropIFD       uint16 = 0xa005
+	tagLensModel        uint16 = 0xa434
+)
+
+// maxExifSize is the largest exif chunk read from png and webp files. Jpeg
+// segments can not be larger.
+const maxExifSize = 1<<16 - 1
+
+var errNoExif = errors.New("no exif data")
+
+// exifData is a parsed exif (TIFF) structure. Only IFD0 and its exif and
+// GPS sub-directories are kept. The thumbnail directory (IFD1) is dropped.
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  []ifdEntry
+	exif  []ifdEntry
+	gps   []ifdEntry
+}
+
+// ifdEntry is a single tag in an image file directory. The value is kept
+// as raw bytes in the byte order of the exif data it was read from.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// readExif returns the raw exif data embedded in a jpeg, png or webp image.
+// errNoExif is returned if the image has no exif data.
+func readExif(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(12)
+	if err != nil && len(magic) < 4 {
+		return nil, errNoExif
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xff, 0xd8}):
+		return readExifJpeg(br)
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		return readExifPng(br)
+	case len(magic) == 12 && bytes.HasPrefix(magic, []byte("RIFF")) && bytes.Equal(magic[8:12], []byte("WEBP")):
+		return readExifWebp(br)
+	}
+	return nil, errNoExif
+}
+
+func readExifJpeg(r io.Reader) ([]byte, error) {
+	// skip SOI
+	if _, err := io.CopyN(io.Discard, r, 2); err != nil {
+		return nil, err
+	}
+	marker := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, errNoExif
+		}
+		if marker[0] != 0xff {
+			return nil, fmt.Errorf("invalid jpeg marker: %x", marker[:2])
+		}
+		// start of scan, no more metadata segments
+		if marker[1] == 0xda {
+			return nil, errNoExif
+		}
+		length := int64(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid jpeg segment length")
+		}
+		if marker[1] != 0xe1 {
+			if _, err := io.CopyN(io.Discard, r, length); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, errNoExif
+		}
+		if tiff, ok := bytes.CutPrefix(seg, []byte("Exif\x00\x00")); ok {
+			return tiff, nil
+		}
+	}
+}
+
+func readExifPng(r io.Reader) ([]byte, error) {
+	// skip signature
+	if _, err := io.CopyN(io.Discard, r, 8); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errNoExif
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "eXIf":
+			if length > maxExifSize {
+				return nil, errNoExif
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errNoExif
+			}
+			return data, nil
+		case "IDAT", "IEND":
+			return nil, errNoExif
+		}
+		// data and crc
+		if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+			return nil, errNoExif
+		}
+	}
+}
+
+func readExifWebp(r io.Reader) ([]byte, error) {
+	// skip RIFF header
+	if _, err := io.CopyN(io.Discard, r, 12); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errNoExif
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		if string(header[:4]) == "EXIF" {
+			if length > maxExifSize {
+				return nil, errNoExif
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errNoExif
+			}
+			// some encoders keep the jpeg style prefix
+			data, _ = bytes.CutPrefix(data, []byte("Exif\x00\x00"))
+			return data, nil
+		}
+		// chunks are padded to an even length
+		if _, err := io.CopyN(io.Discard, r, length+length%2); err != nil {
+			return nil, errNoExif
+		}
+	}
+}
+
+// parseExif parses raw exif data.
+func parseExif(b []byte) (*exifData, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("exif data too short")
+	}
+	e := &exifData{}
+	switch string(b[:4]) {
+	case "II*\x00":
+		e.order = binary.LittleEndian
+	case "MM\x00*":
+		e.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid exif header")
+	}
+
+	ifd0, _, err := readIfd(b, e.order, e.order.Uint32(b[4:8]))
+	if err != nil {
+		return nil, err
+	}
+
+	// sub-directories are kept separately and their pointers are
+	// recreated when the data is encoded
+	for _, entry := range ifd0 {
+		switch entry.tag {
+		case tagExifIFD:
+			if offset, ok := entry.uint(e.order); ok {
+				e.exif, _, _ = readIfd(b, e.order, offset)
+			}
+		case tagGpsIFD:
+			if offset, ok := entry.uint(e.order); ok {
+				e.gps, _, _ = readIfd(b, e.order, offset)
+			}
+		default:
+			e.ifd0 = append(e.ifd0, entry)
+		}
+	}
+	return e, nil
+}
+
+// readIfd reads the image file directory at offset. It returns its entries
+// and the offset of the next directory (0 if there is none).
+func readIfd(b []byte, order binary.ByteOrder, offset uint32) ([]ifdEntry, uint32, error) {
+	if int64(offset)+2 > int64(len(b)) {
+		return nil, 0, fmt.Errorf("exif directory offset out of bounds")
+	}
+	n := int(order.Uint16(b[offset:]))
+	start := int(offset) + 2
+	if start+n*12+4 > len(b) {
+		return nil, 0, fmt.Errorf("exif directory out of bounds")
+	}
+
+	entries := make([]ifdEntry, 0, n)
+	for i := 0; i < n; i++ {
+		raw := b[start+i*12 : start+(i+1)*12]
+		e := ifdEntry{
+			tag:   order.Uint16(raw[0:]),
+			typ:   order.Uint16(raw[2:]),
+			count: order.Uint32(raw[4:]),
+		}
+		size := int64(typeSize(e.typ)) * int64(e.count)
+		if size == 0 {
+			// unknown type, skip it
+			continue
+		}
+		if size <= 4 {
+			e.value = raw[8 : 8+size]
+		} else {
+			valOffset := int64(order.Uint32(raw[8:]))
+			if valOffset+size > int64(len(b)) {
+				continue
+			}
+			e.value = b[valOffset : valOffset+size]
+		}
+		entries = append(entries, e)
+	}
+	next := order.Uint32(b[start+n*12:])
+	return entries, next, nil
+}
+
+// typeSize returns the size in bytes of a single value of the given TIFF type.
+func typeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7: // byte, ascii, sbyte, undefined
+		return 1
+	case 3, 8: // short, sshort
+		return 2
+	case 4, 9, 11: // long, slong, float
+		return 4
+	case 5, 10, 12: // rational, srational, double
+		return 8
+	}
+	return 0
+}
+
+// find returns the entry with the given tag.
+func find(entries []ifdEntry, tag uint16) (ifdEntry, bool) {
+	for _, e := range entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return ifdEntry{}, false
+}
+
+// uint returns the first value of a short or long entry.
+func (e ifdEntry) uint(order binary.ByteOrder) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// rational returns the first value of a rational entry.
+func (e ifdEntry) rational(order binary.ByteOrder) (num, den uint32, ok bool) {
+	if e.typ != 5 || len(e.value) < 8 {
+		return 0, 0, false
+	}
+	return order.Uint32(e.value), order.Uint32(e.value[4:]), true
+}
+
+// orientation returns the value of the Orientation tag, or 1 (normal) if it
+// is missing or invalid.
+func (e *exifData) orientation() int {
+	entry, ok := find(e.ifd0, tagOrientation)
+	if !ok {
+		return 1
+	}
+	v, ok := entry.uint(e.order)
+	if !ok || v < 1 || v > 8 {
+		return 1
+	}
+	return int(v)
+}
+
+// readOrientation returns the exif orientation of the image read from r.
+// Images without exif data have orientation 1 (normal).
+func readOrientation(r io.Reader) int {
+	raw, err := readExif(r)
+	if err != nil {
+		return 1
+	}
+	e, err := parseExif(raw)
+	if err != nil {
+		return 1
+	}
+	return e.orientation()
+}
@@ -0,0 +1,232 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"testing"
+)
+
+func Test_readOrientation(t *testing.T) {
+	t.Parallel()
+	for o := 1; o <= 8; o++ {
+		data := jpegWithOrientation(t, image.NewRGBA(image.Rect(0, 0, 8, 4)), o)
+		if got := readOrientation(bytes.NewReader(data)); got != o {
+			t.Errorf("readOrientation() = %d, want %d", got, o)
+		}
+	}
+
+	// no exif
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOrientation(buf); got != 1 {
+		t.Errorf("readOrientation() without exif = %d, want 1", got)
+	}
+}
+
+func Test_readExif_oversizedChunk(t *testing.T) {
+	t.Parallel()
+	// chunks claiming 4 GiB of exif are not allocated
+	png := []byte("\x89PNG\r\n\x1a\n\xff\xff\xff\xffeXIf")
+	if _, err := readExif(bytes.NewReader(png)); err != errNoExif {
+		t.Errorf("readExif(png) error = %v, want %v", err, errNoExif)
+	}
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPEXIF\xff\xff\xff\xff")
+	if _, err := readExif(bytes.NewReader(webp)); err != errNoExif {
+		t.Errorf("readExif(webp) error = %v, want %v", err, errNoExif)
+	}
+}
+
+func Test_applyOrientation(t *testing.T) {
+	t.Parallel()
+
+	// 3x2 image with a marked top-left pixel
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	marker := color.NRGBA{255, 0, 0, 255}
+	src.Set(0, 0, marker)
+
+	tests := []struct {
+		name        string
+		orientation int
+		wantSize    image.Point
+		wantMarker  image.Point // where the top-left pixel ends up
+	}{
+		{"normal", orientNormal, image.Pt(3, 2), image.Pt(0, 0)},
+		{"flip horizontal", orientFlipH, image.Pt(3, 2), image.Pt(2, 0)},
+		{"rotate 180", orientRotate180, image.Pt(3, 2), image.Pt(2, 1)},
+		{"flip vertical", orientFlipV, image.Pt(3, 2), image.Pt(0, 1)},
+		{"transpose", orientTranspose, image.Pt(2, 3), image.Pt(0, 0)},
+		{"rotate 90", orientRotate90, image.Pt(2, 3), image.Pt(1, 0)},
+		{"transverse", orientTransverse, image.Pt(2, 3), image.Pt(1, 2)},
+		{"rotate 270", orientRotate270, image.Pt(2, 3), image.Pt(0, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyOrientation(src, tt.orientation)
+			if got.Bounds().Size() != tt.wantSize {
+				t.Fatalf("applyOrientation() size = %v, want %v", got.Bounds().Size(), tt.wantSize)
+			}
+			if c := color.NRGBAModel.Convert(got.At(tt.wantMarker.X, tt.wantMarker.Y)); c != marker {
+				t.Errorf("applyOrientation() pixel at %v = %v, want %v", tt.wantMarker, c, marker)
+			}
+		})
+	}
+}
+
+func Test_transformOrientation(t *testing.T) {
+	t.Parallel()
+
+	// 3x2 image with a marked top-left pixel, as still image and animation
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	marker := color.NRGBA{255, 0, 0, 255}
+	src.Set(0, 0, marker)
+	frame := image.NewPaletted(src.Rect, color.Palette{color.Black, marker})
+	frame.SetColorIndex(0, 0, 1)
+	anim := &gif.GIF{Image: []*image.Paletted{frame}, Delay: []int{0}, Config: image.Config{Width: 3, Height: 2}}
+
+	tests := []struct {
+		rot        Rotation
+		flip       Flip
+		wantMarker image.Point // where the top-left pixel ends up
+	}{
+		{Rotate0, FlipNone, image.Pt(0, 0)},
+		{Rotate0, FlipH, image.Pt(2, 0)},
+		{Rotate0, FlipV, image.Pt(0, 1)},
+		{Rotate0, FlipHV, image.Pt(2, 1)},
+		{Rotate90, FlipNone, image.Pt(1, 0)},
+		{Rotate90, FlipH, image.Pt(0, 0)},
+		{Rotate90, FlipV, image.Pt(1, 2)},
+		{Rotate90, FlipHV, image.Pt(0, 2)},
+		{Rotate180, FlipNone, image.Pt(2, 1)},
+		{Rotate180, FlipH, image.Pt(0, 1)},
+		{Rotate180, FlipV, image.Pt(2, 0)},
+		{Rotate180, FlipHV, image.Pt(0, 0)},
+		{Rotate270, FlipNone, image.Pt(0, 2)},
+		{Rotate270, FlipH, image.Pt(1, 2)},
+		{Rotate270, FlipV, image.Pt(0, 0)},
+		{Rotate270, FlipHV, image.Pt(1, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d%s", tt.rot, tt.flip), func(t *testing.T) {
+			o := transformOrientation(tt.rot, tt.flip)
+
+			got := applyOrientation(src, o)
+			if c := color.NRGBAModel.Convert(got.At(tt.wantMarker.X, tt.wantMarker.Y)); c != marker {
+				t.Errorf("image: pixel at %v = %v, want %v", tt.wantMarker, c, marker)
+			}
+
+			gotAnim := orientGif(anim, o)
+			if gotAnim.Image[0].Rect != got.Bounds() {
+				t.Errorf("gif: frame bounds = %v, want %v", gotAnim.Image[0].Rect, got.Bounds())
+			}
+			if i := gotAnim.Image[0].ColorIndexAt(tt.wantMarker.X, tt.wantMarker.Y); i != 1 {
+				t.Errorf("gif: pixel at %v has index %d, want 1", tt.wantMarker, i)
+			}
+
+			// a focal point on the marker moves along with it
+			size := got.Bounds().Size()
+			fp := orientFocus(FocalPoint{X: 0.5 / 3, Y: 0.5 / 2}, o)
+			want := FocalPoint{X: (float64(tt.wantMarker.X) + 0.5) / float64(size.X), Y: (float64(tt.wantMarker.Y) + 0.5) / float64(size.Y)}
+			if math.Abs(fp.X-want.X) > 1e-9 || math.Abs(fp.Y-want.Y) > 1e-9 {
+				t.Errorf("focus = %v, want %v", fp, want)
+			}
+		})
+	}
+}
+
+func TestParseRotation(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{"0", "90", "180", "270"} {
+		if _, err := ParseRotation(s); err != nil {
+			t.Errorf("ParseRotation(%q) error = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "45", "360", "-90"} {
+		if _, err := ParseRotation(s); err == nil {
+			t.Errorf("ParseRotation(%q) expected an error", s)
+		}
+	}
+}
+
+func Test_loadImage_orientation(t *testing.T) {
+	t.Parallel()
+	data := jpegWithOrientation(t, image.NewRGBA(image.Rect(0, 0, 80, 40)), orientRotate90)
+	path := t.TempDir() + "/1.jpeg"
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := loadImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(40, 80) {
+		t.Errorf("loadImage() size = %v, want %v", got, image.Pt(40, 80))
+	}
+}
+
+func Test_bakeOrientation(t *testing.T) {
+	t.Parallel()
+	data := jpegWithOrientation(t, image.NewRGBA(image.Rect(0, 0, 80, 40)), orientRotate270)
+
+	r, err := bakeOrientation(bytes.NewReader(data), Jpeg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baked, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := jpeg.DecodeConfig(bytes.NewReader(baked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Width != 40 || conf.Height != 80 {
+		t.Errorf("bakeOrientation() size = %dx%d, want 40x80", conf.Width, conf.Height)
+	}
+	if got := readOrientation(bytes.NewReader(baked)); got != orientNormal {
+		t.Errorf("bakeOrientation() left orientation %d", got)
+	}
+}
+
+// jpegWithOrientation encodes img as a jpeg with an exif orientation tag.
+func jpegWithOrientation(t *testing.T, img image.Image, orientation int) []byte {
+	t.Helper()
+
+	// little endian TIFF with a single IFD holding the orientation
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II*\x00")
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+	binary.Write(tiff, binary.LittleEndian, uint16(1))
+	binary.Write(tiff, binary.LittleEndian, []uint16{tagOrientation, 3})
+	binary.Write(tiff, binary.LittleEndian, uint32(1))
+	binary.Write(tiff, binary.LittleEndian, []uint16{uint16(orientation), 0})
+	binary.Write(tiff, binary.LittleEndian, uint32(0))
+
+	encoded := &bytes.Buffer{}
+	err := jpeg.Encode(encoded, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert APP1 after SOI
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := &bytes.Buffer{}
+	out.Write(encoded.Bytes()[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
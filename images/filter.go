@@ -0,0 +1,285 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"strings"
+)
+
+const (
+	maxBlur    = 25 // sigma in pixels, the kernel grows with it
+	maxSharpen = 10 // unsharp mask amount
+
+	// sigma of the blur subtracted by the unsharp mask
+	sharpenSigma = 1.0
+)
+
+// Filters are pixel adjustments applied after an image has been resized.
+// They are applied in the order brightness, contrast, saturation, grayscale,
+// blur, sharpen. The zero value changes nothing.
+type Filters struct {
+	// -100 to 100 percent, added to every channel
+	Brightness float64
+	// -100 to 100 percent. -100 gives a flat gray image
+	Contrast float64
+	// -100 to 100 percent. -100 removes all color
+	Saturation float64
+	// convert to shades of gray
+	Grayscale bool
+	// sigma of a gaussian blur in pixels, up to 25
+	Blur float64
+	// amount of an unsharp mask, up to 10. 1 doubles the contrast of edges
+	Sharpen float64
+}
+
+// IsZero reports whether no filter is set.
+func (f Filters) IsZero() bool {
+	return f == Filters{}
+}
+
+// Validate returns an error for every filter that is out of range.
+func (f Filters) Validate() error {
+	errs := []error{}
+	for _, adj := range []struct {
+		name string
+		v    float64
+	}{{"brightness", f.Brightness}, {"contrast", f.Contrast}, {"saturation", f.Saturation}} {
+		if adj.v < -100 || adj.v > 100 || math.IsNaN(adj.v) {
+			errs = append(errs, fmt.Errorf("invalid %s. \n\tGot: '%g'\n\tWant: -100 to 100 (inclusive)", adj.name, adj.v))
+		}
+	}
+	if f.Blur < 0 || f.Blur > maxBlur || math.IsNaN(f.Blur) {
+		errs = append(errs, fmt.Errorf("invalid blur. \n\tGot: '%g'\n\tWant: 0 to %d (inclusive)", f.Blur, maxBlur))
+	}
+	if f.Sharpen < 0 || f.Sharpen > maxSharpen || math.IsNaN(f.Sharpen) {
+		errs = append(errs, fmt.Errorf("invalid sharpen. \n\tGot: '%g'\n\tWant: 0 to %d (inclusive)", f.Sharpen, maxSharpen))
+	}
+	return errors.Join(errs...)
+}
+
+// key returns the filters as part of a file name.
+func (f Filters) key() string {
+	strB := strings.Builder{}
+	if f.Brightness != 0 {
+		strB.WriteString(fmt.Sprintf("_br%g", f.Brightness))
+	}
+	if f.Contrast != 0 {
+		strB.WriteString(fmt.Sprintf("_ct%g", f.Contrast))
+	}
+	if f.Saturation != 0 {
+		strB.WriteString(fmt.Sprintf("_sa%g", f.Saturation))
+	}
+	if f.Grayscale {
+		strB.WriteString("_gray")
+	}
+	if f.Blur != 0 {
+		strB.WriteString(fmt.Sprintf("_bl%g", f.Blur))
+	}
+	if f.Sharpen != 0 {
+		strB.WriteString(fmt.Sprintf("_sh%g", f.Sharpen))
+	}
+	return strB.String()
+}
+
+// adjustsColor reports whether f changes colors independent of their
+// neighbours.
+func (f Filters) adjustsColor() bool {
+	return f.Brightness != 0 || f.Contrast != 0 || f.Saturation != 0 || f.Grayscale
+}
+
+// applyFilters returns a copy of img with f applied. img is returned as is if
+// no filter is set.
+func applyFilters(img image.Image, f Filters) image.Image {
+	if f.IsZero() {
+		return img
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+
+	if f.adjustsColor() {
+		for i := 0; i < len(dst.Pix); i += 4 {
+			c := f.adjust(color.NRGBA{dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3]})
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = c.R, c.G, c.B
+		}
+	}
+	if f.Blur > 0 {
+		dst = gaussianBlur(dst, f.Blur)
+	}
+	if f.Sharpen > 0 {
+		dst = unsharpMask(dst, sharpenSigma, f.Sharpen)
+	}
+	return dst
+}
+
+// adjust applies the color adjustments of f to c. Alpha is kept.
+func (f Filters) adjust(c color.NRGBA) color.NRGBA {
+	rgb := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+
+	contrast := 1 + f.Contrast/100
+	for i, v := range rgb {
+		v += 255 * f.Brightness / 100
+		v = (v-127.5)*contrast + 127.5
+		rgb[i] = v
+	}
+
+	saturation := 1 + f.Saturation/100
+	if f.Grayscale {
+		saturation = 0
+	}
+	if saturation != 1 {
+		lum := luminance(rgb[0], rgb[1], rgb[2])
+		for i, v := range rgb {
+			rgb[i] = lum + (v-lum)*saturation
+		}
+	}
+	return color.NRGBA{clampUint8(rgb[0]), clampUint8(rgb[1]), clampUint8(rgb[2]), c.A}
+}
+
+// luminance returns the perceived brightness of a color (ITU-R BT.601).
+func luminance(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// gaussianBlur returns src blurred with the given sigma. Colors are blurred
+// premultiplied by alpha so transparent pixels do not darken their
+// neighbours. Pixels outside of src repeat its edge.
+func gaussianBlur(src *image.NRGBA, sigma float64) *image.NRGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+
+	// premultiplied channels
+	buf := make([]float32, w*h*4)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			si := src.PixOffset(x+src.Rect.Min.X, y+src.Rect.Min.Y)
+			a := float32(src.Pix[si+3]) / 255
+			bi := (y*w + x) * 4
+			buf[bi] = float32(src.Pix[si]) * a
+			buf[bi+1] = float32(src.Pix[si+1]) * a
+			buf[bi+2] = float32(src.Pix[si+2]) * a
+			buf[bi+3] = float32(src.Pix[si+3])
+		}
+	}
+
+	// the kernel is separable, blur rows then columns
+	tmp := make([]float32, len(buf))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float32
+			for k, weight := range kernel {
+				sx := clampInt(x+k-radius, 0, w-1)
+				bi := (y*w + sx) * 4
+				for c := range sum {
+					sum[c] += buf[bi+c] * weight
+				}
+			}
+			copy(tmp[(y*w+x)*4:], sum[:])
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float32
+			for k, weight := range kernel {
+				sy := clampInt(y+k-radius, 0, h-1)
+				bi := (sy*w + x) * 4
+				for c := range sum {
+					sum[c] += tmp[bi+c] * weight
+				}
+			}
+			copy(buf[(y*w+x)*4:], sum[:])
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(buf); i += 4 {
+		a := buf[i+3]
+		dst.Pix[i+3] = clampUint8(float64(a))
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			dst.Pix[i+c] = clampUint8(float64(buf[i+c] * 255 / a))
+		}
+	}
+	return dst
+}
+
+// gaussianKernel returns a normalized kernel reaching 3 sigma to each side.
+func gaussianKernel(sigma float64) []float32 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float32, radius*2+1)
+	sum := float32(0)
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = float32(math.Exp(-d * d / (2 * sigma * sigma)))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// unsharpMask sharpens src by adding amount times the difference between src
+// and a blurred copy of it. Alpha is kept.
+func unsharpMask(src *image.NRGBA, sigma, amount float64) *image.NRGBA {
+	blurred := gaussianBlur(src, sigma)
+	dst := image.NewNRGBA(blurred.Rect)
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			si := src.PixOffset(x+src.Rect.Min.X, y+src.Rect.Min.Y)
+			di := dst.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				v := float64(src.Pix[si+c])
+				dst.Pix[di+c] = clampUint8(v + (v-float64(blurred.Pix[di+c]))*amount)
+			}
+			dst.Pix[di+3] = src.Pix[si+3]
+		}
+	}
+	return dst
+}
+
+// filterGif returns anim with f applied to every frame. Color adjustments
+// are applied to the palettes. Blurred and sharpened frames are mapped back
+// to their own palette without dithering to avoid flicker.
+func filterGif(anim *gif.GIF, f Filters) *gif.GIF {
+	if f.IsZero() {
+		return anim
+	}
+
+	out := *anim
+	out.Image = make([]*image.Paletted, len(anim.Image))
+	for i, frame := range anim.Image {
+		palette := frame.Palette
+		if f.adjustsColor() {
+			palette = make(color.Palette, len(frame.Palette))
+			for j, c := range frame.Palette {
+				palette[j] = f.adjust(color.NRGBAModel.Convert(c).(color.NRGBA))
+			}
+		}
+
+		if f.Blur == 0 && f.Sharpen == 0 {
+			out.Image[i] = &image.Paletted{Pix: frame.Pix, Stride: frame.Stride, Rect: frame.Rect, Palette: palette}
+			continue
+		}
+
+		spatial := Filters{Blur: f.Blur, Sharpen: f.Sharpen}
+		filtered := applyFilters(&image.Paletted{Pix: frame.Pix, Stride: frame.Stride, Rect: frame.Rect, Palette: palette}, spatial)
+		dst := image.NewPaletted(frame.Rect, palette)
+		draw.Draw(dst, dst.Rect, filtered, image.Point{}, draw.Src)
+		out.Image[i] = dst
+	}
+	return &out
+}
@@ -0,0 +1,128 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestFilters_adjust(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		f    Filters
+		c    color.NRGBA
+		want color.NRGBA
+	}{
+		{"none", Filters{}, color.NRGBA{10, 20, 30, 40}, color.NRGBA{10, 20, 30, 40}},
+		{"grayscale", Filters{Grayscale: true}, color.NRGBA{255, 0, 0, 255}, color.NRGBA{76, 76, 76, 255}},
+		{"desaturate", Filters{Saturation: -100}, color.NRGBA{255, 0, 0, 128}, color.NRGBA{76, 76, 76, 128}},
+		{"brighter", Filters{Brightness: 20}, color.NRGBA{0, 100, 250, 255}, color.NRGBA{51, 151, 255, 255}},
+		{"darker", Filters{Brightness: -100}, color.NRGBA{0, 100, 250, 255}, color.NRGBA{0, 0, 0, 255}},
+		{"flat", Filters{Contrast: -100}, color.NRGBA{0, 100, 250, 255}, color.NRGBA{128, 128, 128, 255}},
+		{"contrast", Filters{Contrast: 100}, color.NRGBA{100, 128, 150, 255}, color.NRGBA{73, 129, 173, 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.adjust(tt.c); got != tt.want {
+				t.Errorf("Filters.adjust() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilters_Validate(t *testing.T) {
+	t.Parallel()
+	valid := []Filters{{}, {Brightness: -100, Contrast: 100, Saturation: 50}, {Blur: 25, Sharpen: 10, Grayscale: true}}
+	for _, f := range valid {
+		if err := f.Validate(); err != nil {
+			t.Errorf("Filters%+v.Validate() error = %v", f, err)
+		}
+	}
+	invalid := []Filters{{Brightness: 101}, {Contrast: -101}, {Blur: -1}, {Blur: 26}, {Sharpen: 11}}
+	for _, f := range invalid {
+		if err := f.Validate(); err == nil {
+			t.Errorf("Filters%+v.Validate() expected an error", f)
+		}
+	}
+}
+
+func Test_gaussianBlur(t *testing.T) {
+	t.Parallel()
+
+	// left half black, right half white, top row transparent
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for y := 1; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			if x >= 10 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	got := gaussianBlur(src, 2)
+	if got.Bounds() != src.Bounds() {
+		t.Fatalf("gaussianBlur() bounds = %v, want %v", got.Bounds(), src.Bounds())
+	}
+	// far from the edge nothing changes
+	if c := got.NRGBAAt(0, 8); c != (color.NRGBA{0, 0, 0, 255}) {
+		t.Errorf("gaussianBlur() at (0, 8) = %v, want black", c)
+	}
+	// the edge is softened
+	if c := got.NRGBAAt(10, 5); c.R == 255 || c.R < 128 {
+		t.Errorf("gaussianBlur() at (10, 5) = %v, want light gray", c)
+	}
+	// transparent pixels do not darken their neighbours
+	if c := got.NRGBAAt(19, 0); c.A == 0 || c.R != 255 {
+		t.Errorf("gaussianBlur() at (19, 0) = %v, want partly transparent white", c)
+	}
+}
+
+func Test_unsharpMask(t *testing.T) {
+	t.Parallel()
+	src := image.NewNRGBA(image.Rect(0, 0, 10, 1))
+	for x := 0; x < 10; x++ {
+		v := uint8(100)
+		if x >= 5 {
+			v = 150
+		}
+		src.Set(x, 0, color.NRGBA{v, v, v, 255})
+	}
+
+	got := unsharpMask(src, sharpenSigma, 1)
+	if c := got.NRGBAAt(4, 0); c.R >= 100 {
+		t.Errorf("unsharpMask() at (4, 0) = %v, want darker than 100", c)
+	}
+	if c := got.NRGBAAt(5, 0); c.R <= 150 {
+		t.Errorf("unsharpMask() at (5, 0) = %v, want lighter than 150", c)
+	}
+	if c := got.NRGBAAt(0, 0); c.R != 100 {
+		t.Errorf("unsharpMask() at (0, 0) = %v, want 100", c)
+	}
+}
+
+func Test_filterGif(t *testing.T) {
+	t.Parallel()
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.NRGBA{255, 0, 0, 255}, color.Transparent})
+	anim := &gif.GIF{Image: []*image.Paletted{frame}, Delay: []int{5}, LoopCount: 2}
+
+	got := filterGif(anim, Filters{Grayscale: true})
+	if len(got.Image) != 1 || got.Delay[0] != 5 || got.LoopCount != 2 {
+		t.Fatalf("filterGif() changed the animation: %+v", got)
+	}
+	if c := color.NRGBAModel.Convert(got.Image[0].At(0, 0)); c != (color.NRGBA{76, 76, 76, 255}) {
+		t.Errorf("filterGif() color = %v, want gray", c)
+	}
+	// the original is left untouched
+	if c := color.NRGBAModel.Convert(frame.At(0, 0)); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("filterGif() changed the original frame to %v", c)
+	}
+
+	got = filterGif(anim, Filters{Blur: 1})
+	if got.Image[0].Rect != frame.Rect {
+		t.Errorf("filterGif() bounds = %v, want %v", got.Image[0].Rect, frame.Rect)
+	}
+}
@@ -0,0 +1,164 @@
+package images
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// Fit represents how an image is fitted into a box when both width and
+// height are given.
+type Fit string
+
+const (
+	FitCover   Fit = "cover"   // crop to the ratio of the box
+	FitContain Fit = "contain" // letterbox, padded with the background color
+	FitFill    Fit = "fill"    // stretch to the box
+	FitInside  Fit = "inside"  // scale down to fit within the box, never up
+)
+
+func (f Fit) String() string {
+	return string(f)
+}
+
+func ParseFit(s string) (Fit, error) {
+	switch s {
+	case "cover":
+		return FitCover, nil
+	case "contain":
+		return FitContain, nil
+	case "fill":
+		return FitFill, nil
+	case "inside":
+		return FitInside, nil
+	}
+	return "", fmt.Errorf("invalid fit. \n\tGot: '%s'\n\tWant: 'cover', 'contain', 'fill', 'inside'", s)
+}
+
+// ParseColor parses a hex color as "rgb", "rrggbb" or "rrggbbaa", with or
+// without a leading '#'.
+func ParseColor(s string) (color.NRGBA, error) {
+	hexStr := strings.TrimPrefix(s, "#")
+	if len(hexStr) == 3 {
+		hexStr = string([]byte{hexStr[0], hexStr[0], hexStr[1], hexStr[1], hexStr[2], hexStr[2]})
+	}
+	if len(hexStr) == 6 {
+		hexStr += "ff"
+	}
+	b, err := hex.DecodeString(hexStr)
+	if err != nil || len(b) != 4 {
+		return color.NRGBA{}, fmt.Errorf("invalid color. \n\tGot: '%s'\n\tWant: hex color as 'rgb', 'rrggbb' or 'rrggbbaa'", s)
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+}
+
+// background returns the color used to pad an image. A background that is
+// not set is transparent for formats that support it and white otherwise.
+func background(params ImageParameters) color.Color {
+	if params.hasBackground() {
+		return params.Background
+	}
+	switch params.Format {
+	case Png, Png8, Webp:
+		return color.Transparent
+	}
+	return color.White
+}
+
+// fitOptions controls how an image is fitted into a box.
+type fitOptions struct {
+	fit    Fit
+	bg     color.Color // padding for FitContain
+	focus  FocalPoint  // center of the crop for FitCover
+	interp resize.InterpolationFunction
+}
+
+// fitImage resizes img to width x height according to opts. If width or
+// height is 0 the aspect ratio of img is kept and the fit only matters for
+// FitInside.
+func fitImage(img image.Image, width, height uint, opts fitOptions) image.Image {
+	b := img.Bounds()
+	interp := opts.interp
+	if opts.fit == FitInside {
+		w, h := insideSize(b.Dx(), b.Dy(), width, height)
+		return resize.Resize(w, h, img, interp)
+	}
+	if width == 0 || height == 0 {
+		return resize.Resize(width, height, img, interp)
+	}
+
+	switch opts.fit {
+	case FitFill:
+		return resize.Resize(width, height, img, interp)
+	case FitContain:
+		w, h := containSize(b.Dx(), b.Dy(), width, height)
+		scaled := resize.Resize(w, h, img, interp)
+
+		dst := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+		draw.Draw(dst, dst.Rect, image.NewUniform(opts.bg), image.Point{}, draw.Src)
+		offset := image.Pt((int(width)-int(w))/2, (int(height)-int(h))/2)
+		sb := scaled.Bounds()
+		draw.Draw(dst, sb.Sub(sb.Min).Add(offset), scaled, sb.Min, draw.Over)
+		return dst
+	}
+	return resize.Resize(width, height, cropToRatio(img, int(width), int(height), opts.focus), interp)
+}
+
+// containSize returns the largest size with the ratio of w x h that fits
+// within the box.
+func containSize(w, h int, boxW, boxH uint) (uint, uint) {
+	s := math.Min(float64(boxW)/float64(w), float64(boxH)/float64(h))
+	return scaleSize(w, h, s)
+}
+
+// insideSize works like containSize but never scales up. A box width or
+// height of 0 does not constrain the size.
+func insideSize(w, h int, boxW, boxH uint) (uint, uint) {
+	s := 1.0
+	if boxW != 0 {
+		s = math.Min(s, float64(boxW)/float64(w))
+	}
+	if boxH != 0 {
+		s = math.Min(s, float64(boxH)/float64(h))
+	}
+	return scaleSize(w, h, s)
+}
+
+func scaleSize(w, h int, s float64) (uint, uint) {
+	return uint(math.Max(1, math.Round(float64(w)*s))), uint(math.Max(1, math.Round(float64(h)*s)))
+}
+
+// fitGif works like fitImage for animations. Only the part canvas of the
+// animation is used. Padding added by FitContain is left transparent.
+func fitGif(anim *gif.GIF, canvas image.Rectangle, width, height uint, opts fitOptions) *gif.GIF {
+	interp := opts.interp
+	if opts.fit == FitInside {
+		w, h := insideSize(canvas.Dx(), canvas.Dy(), width, height)
+		return resizeGif(anim, canvas, w, h, interp)
+	}
+	if width == 0 || height == 0 {
+		return resizeGif(anim, canvas, width, height, interp)
+	}
+
+	switch opts.fit {
+	case FitFill:
+		return resizeGif(anim, canvas, width, height, interp)
+	case FitContain:
+		w, h := containSize(canvas.Dx(), canvas.Dy(), width, height)
+		out := resizeGif(anim, canvas, w, h, interp)
+		offset := image.Pt((int(width)-int(w))/2, (int(height)-int(h))/2)
+		for _, frame := range out.Image {
+			frame.Rect = frame.Rect.Add(offset)
+		}
+		out.Config.Width, out.Config.Height = int(width), int(height)
+		return out
+	}
+	return resizeGif(anim, cropRect(canvas, int(width), int(height), opts.focus), width, height, interp)
+}
@@ -0,0 +1,80 @@
+package images
+
+import (
+	"fmt"
+)
+
+// FocalPoint is the point of interest in an image, given as fractions of its
+// width and height. (0, 0) is the top-left corner and (1, 1) the bottom-right.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// focusCenter is used for images without a focal point.
+var focusCenter = FocalPoint{X: 0.5, Y: 0.5}
+
+func (fp FocalPoint) validate() error {
+	if fp.X < 0 || fp.X > 1 || fp.Y < 0 || fp.Y > 1 {
+		return ErrInvalidFocalPoint{FocalPoint: fp}
+	}
+	return nil
+}
+
+// Focus returns the focal point of the image with the given id. Images
+// without a focal point are focused on their center.
+func (h *ImageHandler) Focus(id int) (FocalPoint, error) {
+	_, err := h.originalPath(id)
+	if err != nil {
+		return FocalPoint{}, err
+	}
+	sc, err := h.readSidecar(id)
+	if err != nil {
+		return FocalPoint{}, err
+	}
+	if sc.Focus == nil {
+		return focusCenter, nil
+	}
+	return *sc.Focus, nil
+}
+
+// SetFocus sets the focal point of the image with the given id. Cached
+// images of the id and all sheets are removed as they may have been cropped
+// differently.
+func (h *ImageHandler) SetFocus(id int, fp FocalPoint) error {
+	h.opts.l.Debug("SetFocus", "id", id, "focus", fp)
+	err := fp.validate()
+	if err != nil {
+		return err
+	}
+	_, err = h.originalPath(id)
+	if err != nil {
+		return err
+	}
+
+	err = h.updateSidecar(id, func(sc *sidecar) {
+		sc.Focus = &fp
+	})
+	if err != nil {
+		return fmt.Errorf("could not store focal point: %w", err)
+	}
+
+	numDeleted := h.cache.Delete(id)
+	numDeleted += h.cache.Delete(sheetCacheId)
+	h.opts.l.Debug("SetFocus", "cache entries removed", numDeleted)
+	return nil
+}
+
+// ErrInvalidFocalPoint is returned when a focal point is outside of the image.
+type ErrInvalidFocalPoint struct {
+	FocalPoint FocalPoint
+}
+
+func (e ErrInvalidFocalPoint) Error() string {
+	return fmt.Sprintf("focal point (%g, %g) must be within 0 and 1 (inclusive)", e.FocalPoint.X, e.FocalPoint.Y)
+}
+
+func (e ErrInvalidFocalPoint) Is(err error) bool {
+	_, ok := err.(ErrInvalidFocalPoint)
+	return ok
+}
@@ -1,9 +1,13 @@
 package images
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
@@ -12,10 +16,11 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/chai2010/webp"
 	"github.com/charmbracelet/log"
 	"github.com/johan-st/go-image-server/units/size"
 
@@ -27,10 +32,6 @@ import (
 	// eqvivalent on creation.
 )
 
-const (
-	originalsExt = ".jpeg" //somewhat of a hack. all originals are saved and retrieved with this extention TODO: find a better way?
-)
-
 // ImageHandler is the main type of this package.
 type ImageHandler struct {
 	opts options
@@ -38,6 +39,22 @@ type ImageHandler struct {
 	mu       sync.Mutex
 	latestId int
 
+	// sidecars read so far, see sidecar.go
+	sidecarMu sync.Mutex
+	sidecars  map[int]sidecar
+
+	// watermark files read so far, see watermark.go
+	watermarkMu sync.Mutex
+	watermarks  map[string]image.Image
+
+	// originals maps ids to the format the original is stored in.
+	originals map[int]Format
+	// hashes maps the SHA-256 of originals to their id, see dedupe.go
+	hashes map[string]int
+	// uploads that hold the hash of their content in hashes but are not
+	// stored yet. The channel is closed once they are stored or failed.
+	pending map[int]chan struct{}
+
 	cache cache
 
 	presets map[string]ImagePreset
@@ -61,19 +78,67 @@ type ImageParameters struct {
 
 	Format
 
-	// Jpeg:1-100, Gif:1-256
+	// Jpeg:1-100, Gif:1-256, Webp:1-100, Png: compression level 1-9, Png8:
+	// number of colors 2-256
 	Quality int
 
+	// Webp only. Encode losslessly, Quality is ignored.
+	Lossless bool
+
+	// Gif and Png8 only. How colors missing from the palette are
+	// approximated (zero value = Floyd-Steinberg)
+	Dither Dither
+
 	// width and Height in pixels (0 = keep aspect ratio, both width and height can not be 0)
 	Width  uint
 	Height uint
 
+	// Device pixel ratio, 1 to 4. Width and Height are multiplied by it (0 =
+	// 1). Not part of the cache key as the multiplied size is.
+	Dpr float64
+
 	// Max file-size in bytes (0 = no limit)
 	MaxSize size.S
 
-	// TODO: implement
 	// Interpolation function used if a new cache file is created
-	// Interpolation Interpolation
+	Interpolation Interpolation
+
+	// Metadata from the original kept in the created image
+	Metadata Metadata
+
+	// Frame of an animated original to use, starting at 1 (0 = all frames
+	// for gif, the first frame for other formats)
+	Frame uint
+
+	// How the image is fitted when both width and height are set
+	Fit Fit
+	// Padding color for FitContain (zero value = the default background,
+	// transparent if the format supports it and white otherwise)
+	Background color.NRGBA
+	// Background was given, also if it is transparent
+	BackgroundSet bool
+	// Pad with the dominant color of the original instead of Background
+	DominantBackground bool
+
+	// Region of the original to use, cut out before resizing (zero value =
+	// the whole image)
+	Crop Crop
+
+	// Clockwise rotation and flip applied after Crop
+	Rotate Rotation
+	Flip   Flip
+
+	// Pixel adjustments applied after resizing
+	Filters Filters
+
+	// Image composited onto the result, usually set by a preset
+	Watermark Watermark
+
+	// Text drawn onto the result, usually set by a preset
+	Caption Caption
+
+	// focal point of the image, set by Get (nil = center)
+	focus *FocalPoint
 }
 
 // New creates a new Imageandler and applies the given options.
@@ -115,15 +180,40 @@ func New(optFuncs ...optFunc) (*ImageHandler, error) {
 
 		cache: newLru(opts.cacheMaxNum, evictedChan),
 
+		hashes:     make(map[string]int),
+		pending:    make(map[int]chan struct{}),
+		sidecars:   make(map[int]sidecar),
+		watermarks: make(map[string]image.Image),
+
 		presets: presetsMap(opts.imagePresets),
 	}
 
+	err = ih.loadOriginals()
+	if err != nil {
+		opts.l.Error("could not load originals during setup.", "error", err)
+		return nil, err
+	}
+
 	ih.latestId, err = ih.findLatestId()
 	if err != nil {
 		opts.l.Fatal("could not get latest id during setup.", "error", err)
 		return nil, err
 	}
 
+	if opts.dedupe {
+		err = ih.loadHashes()
+		if err != nil {
+			opts.l.Error("could not load hashes of originals during setup.", "error", err)
+			return nil, err
+		}
+	}
+
+	err = ih.loadDHashes()
+	if err != nil {
+		opts.l.Error("could not load perceptual hashes of originals during setup.", "error", err)
+		return nil, err
+	}
+
 	l.Debug("Creating new ImageHandler", "number of options set", len(optFuncs), "resulting options", opts.String())
 	return &ih, nil
 }
@@ -131,7 +221,41 @@ func New(optFuncs ...optFunc) (*ImageHandler, error) {
 // returns the path to the processed image.
 func (h *ImageHandler) Get(params ImageParameters) (string, error) {
 	// normalize parameters with defaults
+	err := h.applyDpr(&params)
+	if err != nil {
+		return "", err
+	}
+	// only gifs have frames, other originals would be cached once per frame
+	if params.Frame != 0 {
+		_, format, err := h.original(params.Id)
+		if err != nil {
+			return "", err
+		}
+		if format != Gif {
+			return "", ErrInvalidFrame{Frame: params.Frame, Format: format}
+		}
+	}
 	params.apply(h.opts.imageDefaults) //TODO: test this
+	params.Width, params.Height = capDimensions(params.Width, params.Height, uint(h.opts.imageDefaults.MaxDimension))
+	if params.DominantBackground && params.Fit == FitContain {
+		c, ok, err := h.dominantColor(params.Id)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			params.Background = c
+		}
+	}
+
+	// variants cropped around a focal point are cached separately, so
+	// changing it never serves a stale crop
+	focus, err := h.Focus(params.Id)
+	if err != nil {
+		return "", err
+	}
+	if focus != focusCenter {
+		params.focus = &focus
+	}
 	cachePath := h.cachePath(params)
 	h.opts.l.Debug("Get", "ImageParameters", params, "cachePath", cachePath)
 
@@ -156,7 +280,8 @@ func (h *ImageHandler) Get(params ImageParameters) (string, error) {
 	return cachePath, nil
 }
 
-// Returns id of the added image
+// Returns id of the added image. With dedupe enabled, the id of an identical
+// original that was added before is returned together with ErrDuplicate.
 func (h *ImageHandler) Add(r io.Reader) (int, error) {
 	h.opts.l.Debug("Add called on imageHandler")
 
@@ -168,13 +293,24 @@ func (h *ImageHandler) Add(r io.Reader) (int, error) {
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
 
-	tr := io.TeeReader(r, tmpFile)
+	hash := sha256.New()
+	tr := io.TeeReader(r, io.MultiWriter(tmpFile, hash))
 
 	// decode image
-	_, _, err = image.Decode(tr)
+	_, formatName, err := image.Decode(tr)
 	if err != nil {
 		return 0, err
 	}
+	format, err := ParseFormat(formatName)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", image.ErrFormat, err)
+	}
+
+	// the decoder might not consume all of the input
+	_, err = io.Copy(io.Discard, tr)
+	if err != nil {
+		return 0, fmt.Errorf("could not read upload: %w", err)
+	}
 
 	// seek to start
 	_, err = tmpFile.Seek(0, io.SeekStart)
@@ -182,13 +318,31 @@ func (h *ImageHandler) Add(r io.Reader) (int, error) {
 		return 0, fmt.Errorf("could not read from tmpFile: %w", err)
 	}
 
+	sum := hex.EncodeToString(hash.Sum(nil))
+
 	// get a new id
-	h.mu.Lock()
-	h.latestId++
-	id := h.latestId
-	h.mu.Unlock()
+	id, err := h.newId(sum)
+	if err != nil {
+		return id, err
+	}
+	stored := false
+	defer func() { h.releaseHash(sum, id, stored) }()
 
-	dst := h.opts.dirOriginals + "/" + strconv.Itoa(id) + originalsExt
+	var src io.Reader = tmpFile
+	if h.opts.bakeOrientation {
+		src, err = bakeOrientation(tmpFile, format)
+		if err != nil {
+			return 0, fmt.Errorf("could not apply orientation: %w", err)
+		}
+	}
+	if h.opts.scrubGps {
+		src, err = scrubGps(src, format)
+		if err != nil {
+			return 0, fmt.Errorf("could not remove location data: %w", err)
+		}
+	}
+
+	dst := filepath.Join(h.opts.dirOriginals, originalName(id, format))
 	// copy file to originals
 	dstFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -196,11 +350,31 @@ func (h *ImageHandler) Add(r io.Reader) (int, error) {
 	}
 	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, tmpFile)
+	_, err = io.Copy(dstFile, src)
 	if err != nil {
 		return 0, fmt.Errorf("could not copy file: %w", err)
 	}
 
+	err = h.updateSidecar(id, func(sc *sidecar) { sc.Sha256 = sum })
+	if err != nil {
+		return 0, fmt.Errorf("could not store hash: %w", err)
+	}
+
+	h.mu.Lock()
+	h.originals[id] = format
+	h.mu.Unlock()
+	stored = true
+
+	// both are computed when first asked for if this fails
+	_, err = h.Info(id)
+	if err != nil {
+		h.opts.l.Warn("could not read image info", "id", id, "error", err)
+	}
+	_, err = h.dHash(id)
+	if err != nil {
+		h.opts.l.Warn("could not compute perceptual hash", "id", id, "error", err)
+	}
+
 	// return id
 	return id, nil
 }
@@ -209,39 +383,29 @@ func (h *ImageHandler) Add(r io.Reader) (int, error) {
 func (h *ImageHandler) Ids() ([]int, error) {
 	h.opts.l.Debug("ListIds")
 
-	dir, err := os.Open(h.opts.dirOriginals)
-	if err != nil {
-		h.opts.l.Error("ListIds", "error", err)
-		return nil, err
+	h.mu.Lock()
+	ids := make([]int, 0, len(h.originals))
+	for id := range h.originals {
+		ids = append(ids, id)
 	}
-	defer dir.Close()
+	h.mu.Unlock()
 
-	// get list of files
-	files, err := dir.Readdir(0)
-	if err != nil {
-		h.opts.l.Error("ListIds", "error", err)
-		return nil, err
-	}
+	sort.Ints(ids)
+	return ids, nil
+}
 
-	ids := []int{}
-	for _, f := range files {
-		if f.IsDir() {
-			continue
-		}
-		// add id to list
-		idStr := strings.Split(f.Name(), ".")[0]
-		idInt, err := strconv.Atoi(idStr)
-		if err != nil {
-			h.opts.l.Error("ListIds", "error", err)
-			return nil, err
-		}
-		id := idInt
+// DefaultFormat returns the format used when none is requested.
+func (h *ImageHandler) DefaultFormat() Format {
+	return h.opts.imageDefaults.Format
+}
 
-		ids = append(ids, id)
-	}
-	return ids, nil
+// MaxDimension returns the largest width or height created, 0 for no limit.
+func (h *ImageHandler) MaxDimension() int {
+	return h.opts.imageDefaults.MaxDimension
 }
 
+// GetPreset returns the preset with the given name or alias. Its Name is
+// the canonical name to refer to it by.
 func (h *ImageHandler) GetPreset(preset string) (ImagePreset, bool) {
 	p, ok := h.presets[preset]
 	if !ok {
@@ -253,13 +417,32 @@ func (h *ImageHandler) GetPreset(preset string) (ImagePreset, bool) {
 func (h *ImageHandler) Delete(id int) error {
 	h.opts.l.Debug("Delete", "id", id)
 	// TODO: lock while deleting?
-	oPath := h.originalPath(id)
-	err := os.Remove(oPath)
+	oPath, err := h.originalPath(id)
 	if err != nil {
 		return err
 	}
+	sc, err := h.readSidecar(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(oPath)
+	if err != nil {
+		return err
+	}
+	err = h.deleteSidecar(id)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	delete(h.originals, id)
+	if h.hashes[sc.Sha256] == id {
+		delete(h.hashes, sc.Sha256)
+	}
+	h.mu.Unlock()
 
 	numDeleted := h.cache.Delete(id)
+	numDeleted += h.cache.Delete(sheetCacheId)
 	h.opts.l.Debug("Delete", "cache entries removed", numDeleted)
 
 	return nil
@@ -273,7 +456,11 @@ func (h *ImageHandler) Stat() (Stat, error) {
 	}
 	var sizeOrig size.S
 	for _, i := range ids {
-		size, err := sizeFile(h.originalPath(i))
+		oPath, err := h.originalPath(i)
+		if err != nil {
+			return Stat{}, err
+		}
+		size, err := sizeFile(oPath)
 		if err != nil {
 			return Stat{}, err
 		}
@@ -289,7 +476,10 @@ func (h *ImageHandler) Stat() (Stat, error) {
 func (h *ImageHandler) StatId(id int) (ImageStat, error) {
 	h.opts.l.Debug("StatId", "id", id)
 
-	oPath := h.originalPath(id)
+	oPath, err := h.originalPath(id)
+	if err != nil {
+		return ImageStat{}, err
+	}
 	oSize, err := sizeFile(oPath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -341,65 +531,252 @@ func (h *ImageHandler) findLatestId() (int, error) {
 // Create a new image with the given configuration and
 // returns the path to the cached image.
 func (h *ImageHandler) createImage(params ImageParameters, cachePath string) (size.S, error) {
-	oPath := h.originalPath(params.Id)
-	oImg, err := loadImage(oPath)
+	oPath, oFormat, err := h.original(params.Id)
 	if err != nil {
 		return 0, err
 	}
 
-	file, err := os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	var oImg image.Image
+	if oFormat == Gif {
+		anim, err := loadGif(oPath)
+		if err != nil {
+			return 0, err
+		}
+		if len(anim.Image) > 1 && params.Format == Gif && params.Frame == 0 {
+			return h.createAnimation(params, anim, cachePath)
+		}
+		oImg = gifFrame(anim, params.Frame)
+	} else {
+		oImg, err = loadImage(oPath)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	process, err := h.renderer(oImg, params)
+	if err != nil {
+		return 0, err
+	}
+	img, err := process(params.Width, params.Height)
 	if err != nil {
 		return 0, err
 	}
-	defer file.Close()
 
-	if params.Width != 0 && params.Height != 0 {
-		oImg = cropToRatio(oImg, int(params.Width), int(params.Height))
+	if params.Quality == 0 {
+		switch params.Format {
+		case Jpeg, Webp:
+			params.Quality = 80
+		case Gif, Png8:
+			params.Quality = 256
+		}
 	}
 
-	img := resize.Resize(params.Width, params.Height, oImg, resize.Lanczos3)
+	exif, err := variantExif(oPath, params.Metadata)
+	if err != nil {
+		h.opts.l.Warn("createImage: could not read metadata from original", "error", err, "id", params.Id)
+	}
 
-	switch params.Format {
-	case Jpeg:
-		if params.Quality == 0 {
-			params.Quality = 80
+	qMin, qMax := qualityRange(params)
+	dims := img.Bounds().Size()
+	data, err := fitBudget(params.MaxSize, dims, qMin, qMax, func(w io.Writer, quality int, scale float64) error {
+		scaled := img
+		if scale < 1 {
+			width := uint(math.Max(1, math.Round(float64(dims.X)*scale)))
+			height := uint(math.Max(1, math.Round(float64(dims.Y)*scale)))
+			var err error
+			scaled, err = process(width, height)
+			if err != nil {
+				return err
+			}
+		}
+		p := params
+		p.Quality = quality
+		if exif == nil {
+			return encodeImage(w, scaled, p)
 		}
-		opt := &jpeg.Options{Quality: params.Quality}
-		err = jpeg.Encode(file, img, opt)
+		return encodeImageWithExif(w, scaled, p, exif)
+	})
+	if err != nil {
+		h.opts.l.Warn("createImage", "error", err, "ImageParameters", params)
+		return 0, err
+	}
+	return h.writeCacheFile(cachePath, data)
+}
+
+// renderer returns a function rendering oImg as given by params at a given
+// size. oImg is cropped and oriented once, then every call resizes, filters,
+// watermarks and captions it.
+func (h *ImageHandler) renderer(oImg image.Image, params ImageParameters) (func(width, height uint) (image.Image, error), error) {
+	var err error
+	fitOpts := fitOptionsFor(params)
+	if !params.Crop.IsZero() {
+		oImg, fitOpts.focus, err = cropImage(oImg, params.Crop, fitOpts.focus)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-	case Png:
-		err = png.Encode(file, img)
+	}
+	if o := transformOrientation(params.Rotate, params.Flip); o != orientNormal {
+		oImg = applyOrientation(oImg, o)
+		fitOpts.focus = orientFocus(fitOpts.focus, o)
+	}
+	var mark image.Image
+	if !params.Watermark.IsZero() {
+		mark, err = h.watermarkImage(params.Watermark.Path)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-	case Gif:
-		if params.Quality == 0 {
-			params.Quality = 256
+	}
+	return func(width, height uint) (image.Image, error) {
+		img := applyFilters(fitImage(oImg, width, height, fitOpts), params.Filters)
+		if mark != nil {
+			img = applyWatermark(img, mark, params.Watermark, params.Interpolation)
+		}
+		if !params.Caption.IsZero() {
+			return applyCaption(img, params.Caption)
 		}
-		nc := params.Quality
-		opt := &gif.Options{NumColors: nc}
-		err = gif.Encode(file, img, opt)
+		return img, nil
+	}, nil
+}
+
+// createAnimation creates an animated gif from all frames of anim and
+// returns its size.
+func (h *ImageHandler) createAnimation(params ImageParameters, anim *gif.GIF, cachePath string) (size.S, error) {
+	fitOpts := fitOptionsFor(params)
+	src := gifCanvas(anim)
+	if !params.Crop.IsZero() {
+		r, err := params.Crop.rect(src)
 		if err != nil {
 			return 0, err
 		}
+		fitOpts.focus = fitOpts.focus.within(src, r)
+		src = r
 	}
-	stat, err := file.Stat()
+	if o := transformOrientation(params.Rotate, params.Flip); o != orientNormal {
+		src = orientRect(src, gifCanvas(anim), o)
+		anim = orientGif(anim, o)
+		fitOpts.focus = orientFocus(fitOpts.focus, o)
+	}
+	var mark image.Image
+	if !params.Watermark.IsZero() {
+		var err error
+		mark, err = h.watermarkImage(params.Watermark.Path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// resize, filter, watermark and caption
+	process := func(width, height uint) (*gif.GIF, error) {
+		out := filterGif(fitGif(anim, src, width, height, fitOpts), params.Filters)
+		if mark != nil {
+			out = watermarkGif(out, mark, params.Watermark, params.Interpolation)
+		}
+		if !params.Caption.IsZero() {
+			return captionGif(out, params.Caption)
+		}
+		return out, nil
+	}
+	full, err := process(params.Width, params.Height)
+	if err != nil {
+		return 0, err
+	}
+	dims := image.Pt(full.Config.Width, full.Config.Height)
+
+	// the palettes of the original are kept, only scaling reduces the size
+	data, err := fitBudget(params.MaxSize, dims, 0, 0, func(w io.Writer, _ int, scale float64) error {
+		scaled := full
+		if scale < 1 {
+			width := uint(math.Max(1, math.Round(float64(dims.X)*scale)))
+			height := uint(math.Max(1, math.Round(float64(dims.Y)*scale)))
+			var err error
+			scaled, err = process(width, height)
+			if err != nil {
+				return err
+			}
+		}
+		return gif.EncodeAll(w, scaled)
+	})
 	if err != nil {
+		h.opts.l.Warn("createAnimation", "error", err, "ImageParameters", params)
 		return 0, err
 	}
-	size := size.S(stat.Size())
+	return h.writeCacheFile(cachePath, data)
+}
+
+// fitOptionsFor returns the options used to fit an image according to params.
+func fitOptionsFor(params ImageParameters) fitOptions {
+	focus := focusCenter
+	if params.focus != nil {
+		focus = *params.focus
+	}
+	return fitOptions{
+		fit:    params.Fit,
+		bg:     background(params),
+		focus:  focus,
+		interp: params.Interpolation.function(),
+	}
+}
+
+// writeCacheFile writes a created image to the cache and returns its size.
+func (h *ImageHandler) writeCacheFile(cachePath string, data []byte) (size.S, error) {
+	size := size.S(len(data))
 	if size == 0 {
 		h.opts.l.Error("createImage", "error", "created image has size.size "+size.String(), "path", cachePath)
 		return 0, fmt.Errorf("created image has size.size 0")
 	}
+
+	err := os.WriteFile(cachePath, data, 0644)
+	if err != nil {
+		return 0, err
+	}
 	return size, nil
 }
 
-func (h *ImageHandler) originalPath(id int) string {
-	idStr := strconv.Itoa(id)
-	return filepath.Join(h.opts.dirOriginals, idStr+originalsExt)
+// encodeImage writes img to w in the format and quality given by params.
+func encodeImage(w io.Writer, img image.Image, params ImageParameters) error {
+	switch params.Format {
+	case Jpeg:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: params.Quality})
+	case Png:
+		enc := png.Encoder{CompressionLevel: pngCompression(params.Quality)}
+		return enc.Encode(w, img)
+	case Png8:
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		return enc.Encode(w, quantize(img, params.Quality, params.Dither))
+	case Gif:
+		return gif.Encode(w, quantize(binaryAlpha(img), params.Quality, params.Dither), nil)
+	case Webp:
+		return webp.Encode(w, img, &webp.Options{Quality: float32(params.Quality), Lossless: params.Lossless})
+	}
+	return fmt.Errorf("can not encode image. unknown format: '%s'", params.Format)
+}
+
+// pngCompression maps a compression level from 1 (fastest) to 9 (smallest)
+// to the levels of the png encoder. 0 gives the default level.
+func pngCompression(level int) png.CompressionLevel {
+	switch {
+	case level <= 0:
+		return png.DefaultCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level <= 6:
+		return png.DefaultCompression
+	}
+	return png.BestCompression
+}
+
+// encodeImageWithExif works like encodeImage but embeds the given exif data.
+func encodeImageWithExif(w io.Writer, img image.Image, params ImageParameters, exif []byte) error {
+	buf := &bytes.Buffer{}
+	err := encodeImage(buf, img, params)
+	if err != nil {
+		return err
+	}
+	data, err := embedExif(buf.Bytes(), params.Format, exif)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 func (h *ImageHandler) cachePath(params ImageParameters) string {
@@ -413,26 +790,42 @@ type SubImager interface {
 }
 
 // TODO: IMPLEMENT
-func cropToRatio(i image.Image, width int, height int) image.Image {
-	dx := i.Bounds().Dx()
-	dy := i.Bounds().Dy()
+func cropToRatio(i image.Image, width int, height int, focus FocalPoint) image.Image {
+	subRect := cropRect(i.Bounds(), width, height, focus)
+	if subI, ok := i.(SubImager); ok {
+		return subI.SubImage(subRect)
+	} else {
+		// TODO: need to be looked over when we add imagetypes..
+		// Assumption is tha we do not use any format that does not implement SubImages
+		panic("image was not of type SubImager")
+	}
+}
+
+// cropRect returns the part of bounds with the ratio width:height centered
+// on focus, as far as the bounds allow.
+func cropRect(bounds image.Rectangle, width int, height int, focus FocalPoint) image.Rectangle {
+	dx := bounds.Dx()
+	dy := bounds.Dy()
 	r := float64(width) / float64(height)
 	w, h := ratioToPixels(
 		r,
 		float64(dx),
 		float64(dy),
 	)
-	cropX := (dx - w) / 2
-	cropY := (dy - h) / 2
+	cropX := bounds.Min.X + clampInt(int(math.Round(focus.X*float64(dx)))-w/2, 0, dx-w)
+	cropY := bounds.Min.Y + clampInt(int(math.Round(focus.Y*float64(dy)))-h/2, 0, dy-h)
 
-	subRect := image.Rect(cropX, cropY, w+cropX, h+cropY)
-	if subI, ok := i.(SubImager); ok {
-		return subI.SubImage(subRect)
-	} else {
-		// TODO: need to be looked over when we add imagetypes..
-		// Assumption is tha we do not use any format that does not implement SubImages
-		panic("image was not of type SubImager")
+	return image.Rect(cropX, cropY, w+cropX, h+cropY)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
 	}
+	if v > max {
+		return max
+	}
+	return v
 }
 
 func ratioToPixels(ratioWH, width, height float64) (w int, h int) {
@@ -459,7 +852,13 @@ func loadImage(path string) (image.Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	return img, nil
+
+	// rotate and flip according to exif orientation
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return applyOrientation(img, readOrientation(file)), nil
 }
 
 func checkDirs(l *log.Logger, o *options) error {
@@ -549,8 +948,14 @@ type Format string
 
 const (
 	Jpeg Format = "jpeg" // quality 1-100
-	Png  Format = "png"  // always lossless
+	Png  Format = "png"  // compression level 1-9, always lossless
+	Png8 Format = "png8" // num colors 2-256, palette with alpha
 	Gif  Format = "gif"  // num colors 1-256
+	Webp Format = "webp" // quality 1-100 or lossless
+
+	// Auto is resolved to one of the formats above by the caller, e.g. from
+	// what a client accepts. The default format is used if it is not.
+	Auto Format = "auto"
 )
 
 func (f Format) String() string {
@@ -565,10 +970,16 @@ func ParseFormat(s string) (Format, error) {
 		return Jpeg, nil
 	case "png":
 		return Png, nil
+	case "png8":
+		return Png8, nil
 	case "gif":
 		return Gif, nil
+	case "webp":
+		return Webp, nil
+	case "auto":
+		return Auto, nil
 	}
-	return "", fmt.Errorf("invalid image-format. \n\tGot: %s\n\tWant: 'jpeg', 'jpg', 'png', 'gif'", s)
+	return "", fmt.Errorf("invalid image-format. \n\tGot: %s\n\tWant: 'jpeg', 'jpg', 'png', 'png8', 'gif', 'webp', 'auto'", s)
 }
 
 // Interpolation represents interpolation methods used when resizing images.
@@ -587,6 +998,24 @@ func (r Interpolation) String() string {
 	return string(r)
 }
 
+// function returns the resize function for the interpolation method.
+// Lanczos3 is used if no method is set.
+func (r Interpolation) function() resize.InterpolationFunction {
+	switch r {
+	case NearestNeighbor:
+		return resize.NearestNeighbor
+	case Bilinear:
+		return resize.Bilinear
+	case Bicubic:
+		return resize.Bicubic
+	case MitchellNetrav:
+		return resize.MitchellNetravali
+	case Lanczos2:
+		return resize.Lanczos2
+	}
+	return resize.Lanczos3
+}
+
 func ParseInterpolation(s string) (Interpolation, error) {
 	switch s {
 	case "nearestNeighbor":
@@ -606,11 +1035,61 @@ func ParseInterpolation(s string) (Interpolation, error) {
 }
 
 func (ip *ImageParameters) String() string {
-	return fmt.Sprintf("%d_%dx%d_q%d_s%d.%s", ip.Id, ip.Width, ip.Height, ip.Quality, ip.MaxSize, ip.Format)
+	strB := strings.Builder{}
+	strB.WriteString(fmt.Sprintf("%d_%dx%d_q%d_s%d", ip.Id, ip.Width, ip.Height, ip.Quality, ip.MaxSize))
+	if ip.Lossless {
+		strB.WriteString("_ll")
+	}
+	if (ip.Format == Gif || ip.Format == Png8) && ip.Dither != "" && ip.Dither != DitherFloydSteinberg {
+		strB.WriteString(fmt.Sprintf("_d%s", ip.Dither))
+	}
+	if ip.Interpolation != "" {
+		strB.WriteString(fmt.Sprintf("_i%s", ip.Interpolation))
+	}
+	if ip.Metadata != "" && ip.Metadata != MetadataStrip {
+		strB.WriteString(fmt.Sprintf("_m%s", ip.Metadata))
+	}
+	if ip.Frame != 0 {
+		strB.WriteString(fmt.Sprintf("_f%d", ip.Frame))
+	}
+	if ip.Fit != "" && ip.Fit != FitCover {
+		strB.WriteString(fmt.Sprintf("_%s", ip.Fit))
+	}
+	if ip.focus != nil && ip.Width != 0 && ip.Height != 0 && (ip.Fit == "" || ip.Fit == FitCover) {
+		strB.WriteString(fmt.Sprintf("_fp%g-%g", ip.focus.X, ip.focus.Y))
+	}
+	if !ip.Crop.IsZero() {
+		strB.WriteString(fmt.Sprintf("_c%s", ip.Crop.key()))
+	}
+	if ip.Rotate != Rotate0 {
+		strB.WriteString(fmt.Sprintf("_r%d", ip.Rotate))
+	}
+	if ip.Flip != FlipNone {
+		strB.WriteString(fmt.Sprintf("_fl%s", ip.Flip))
+	}
+	strB.WriteString(ip.Filters.key())
+	if !ip.Watermark.IsZero() {
+		strB.WriteString(fmt.Sprintf("_wm%s", ip.Watermark.key()))
+	}
+	if !ip.Caption.IsZero() {
+		strB.WriteString(fmt.Sprintf("_t%s", ip.Caption.key()))
+	}
+	if ip.Fit == FitContain && ip.hasBackground() {
+		bg := ip.Background
+		strB.WriteString(fmt.Sprintf("_bg%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A))
+	}
+	strB.WriteString(fmt.Sprintf(".%s", ip.Format))
+	return strB.String()
+}
+
+// hasBackground reports whether the background is set. A transparent
+// background only counts if it is given explicitly.
+func (ip ImageParameters) hasBackground() bool {
+	return ip.BackgroundSet || ip.Background != (color.NRGBA{})
 }
 
 func (ip *ImageParameters) apply(def ImageDefaults) {
-	if ip.Format == "" {
+	if ip.Format == "" || ip.Format == Auto {
 		ip.Format = def.Format
 	}
 	if ip.Quality == 0 && ip.Format == Jpeg {
@@ -619,6 +1098,15 @@ func (ip *ImageParameters) apply(def ImageDefaults) {
 	if ip.Quality == 0 && ip.Format == Gif {
 		ip.Quality = def.QualityGif
 	}
+	if ip.Quality == 0 && ip.Format == Webp {
+		ip.Quality = def.QualityWebp
+	}
+	if ip.Quality == 0 && ip.Format == Png {
+		ip.Quality = def.QualityPng
+	}
+	if ip.Quality == 0 && ip.Format == Png8 {
+		ip.Quality = def.QualityPng8
+	}
 	if ip.Width == 0 && ip.Height == 0 {
 		ip.Width = uint(def.Width)
 		ip.Height = uint(def.Height)
@@ -626,6 +1114,21 @@ func (ip *ImageParameters) apply(def ImageDefaults) {
 	if ip.MaxSize == 0 {
 		ip.MaxSize = def.MaxSize
 	}
+	if ip.Interpolation == "" {
+		ip.Interpolation = def.Interpolation
+	}
+	if ip.Metadata == "" {
+		ip.Metadata = def.Metadata
+	}
+	if ip.Fit == "" {
+		ip.Fit = def.Fit
+	}
+	if ip.Dither == "" {
+		ip.Dither = def.Dither
+	}
+	if !ip.hasBackground() {
+		ip.Background = def.Background
+	}
 }
 
 // cache is expected to be thread-safe.
@@ -658,6 +1161,13 @@ type options struct {
 	createDirs     bool
 	setPermissions bool
 
+	// rotate and flip originals according to exif orientation when added
+	bakeOrientation bool
+	// remove location data from originals when added
+	scrubGps bool
+	// return the id of an identical original instead of adding it again
+	dedupe bool
+
 	dirOriginals string
 	dirCache     string
 
@@ -679,6 +1189,9 @@ func (o *options) String() string {
 	}
 	strB.WriteString(fmt.Sprintf("  createDirs: %t\n", o.createDirs))
 	strB.WriteString(fmt.Sprintf("  setPermissions: %t\n", o.setPermissions))
+	strB.WriteString(fmt.Sprintf("  bakeOrientation: %t\n", o.bakeOrientation))
+	strB.WriteString(fmt.Sprintf("  scrubGps: %t\n", o.scrubGps))
+	strB.WriteString(fmt.Sprintf("  dedupe: %t\n", o.dedupe))
 	strB.WriteString(fmt.Sprintf("  originalsDir: %s\n", o.dirOriginals))
 	strB.WriteString(fmt.Sprintf("  cacheDir: %s\n", o.dirCache))
 	strB.WriteString(fmt.Sprintf("  cacheMaxNum: %d\n", o.cacheMaxNum))
@@ -693,10 +1206,25 @@ type ImageDefaults struct {
 	Format      Format
 	QualityJpeg int
 	QualityGif  int
+	QualityWebp int
+	// compression level 1-9
+	QualityPng int
+	// number of colors 2-256
+	QualityPng8 int
 	Width       int
 	Height      int
 	MaxSize     size.S
 	Interpolation
+	Metadata
+	Fit
+	Background color.NRGBA
+	Dither
+
+	// largest width or height created, also when multiplied by a dpr (0 =
+	// no limit)
+	MaxDimension int
+	// never multiply by a dpr past the size of the original
+	DprCapOriginal bool
 }
 
 func (id ImageDefaults) String() string {
@@ -705,10 +1233,19 @@ func (id ImageDefaults) String() string {
 	strB.WriteString(fmt.Sprintf("    format: %s\n", id.Format))
 	strB.WriteString(fmt.Sprintf("    qualityJpeg: %d\n", id.QualityJpeg))
 	strB.WriteString(fmt.Sprintf("    qualityGif: %d\n", id.QualityGif))
+	strB.WriteString(fmt.Sprintf("    qualityWebp: %d\n", id.QualityWebp))
+	strB.WriteString(fmt.Sprintf("    qualityPng: %d\n", id.QualityPng))
+	strB.WriteString(fmt.Sprintf("    qualityPng8: %d\n", id.QualityPng8))
 	strB.WriteString(fmt.Sprintf("    width: %d\n", id.Width))
 	strB.WriteString(fmt.Sprintf("    height: %d\n", id.Height))
 	strB.WriteString(fmt.Sprintf("    maxSize: %s\n", id.MaxSize))
-	strB.WriteString(fmt.Sprintf("    interpolation: %s", id.Interpolation))
+	strB.WriteString(fmt.Sprintf("    interpolation: %s\n", id.Interpolation))
+	strB.WriteString(fmt.Sprintf("    metadata: %s\n", id.Metadata))
+	strB.WriteString(fmt.Sprintf("    fit: %s\n", id.Fit))
+	strB.WriteString(fmt.Sprintf("    background: %v\n", id.Background))
+	strB.WriteString(fmt.Sprintf("    dither: %s\n", id.Dither))
+	strB.WriteString(fmt.Sprintf("    maxDimension: %d\n", id.MaxDimension))
+	strB.WriteString(fmt.Sprintf("    dprCapOriginal: %t", id.DprCapOriginal))
 	return strB.String()
 }
 
@@ -718,14 +1255,29 @@ func (id *ImageDefaults) validate() error {
 }
 
 type ImagePreset struct {
-	Name    string
-	Alias   []string
-	Format  Format
-	Quality int
-	Width   int
-	Height  int
-	MaxSize size.S
+	Name     string
+	Alias    []string
+	Format   Format
+	Quality  int
+	Lossless bool
+	Width    int
+	Height   int
+	MaxSize  size.S
 	Interpolation
+	Metadata
+	Fit
+	Background color.NRGBA
+	Dither     Dither
+	Rotate     Rotation
+	Flip       Flip
+	Filters    Filters
+	Watermark  Watermark
+	Caption    Caption
+
+	// Background was given, also if it is transparent
+	BackgroundSet bool
+	// pad with the dominant color of the original instead of Background
+	DominantBackground bool
 }
 
 func (ip ImagePreset) String() string {
@@ -735,10 +1287,21 @@ func (ip ImagePreset) String() string {
 	strB.WriteString(fmt.Sprintf("      alias: %s\n", ip.Alias))
 	strB.WriteString(fmt.Sprintf("      format: %s\n", ip.Format))
 	strB.WriteString(fmt.Sprintf("      quality: %d\n", ip.Quality))
+	strB.WriteString(fmt.Sprintf("      lossless: %t\n", ip.Lossless))
 	strB.WriteString(fmt.Sprintf("      width: %d\n", ip.Width))
 	strB.WriteString(fmt.Sprintf("      height: %d\n", ip.Height))
 	strB.WriteString(fmt.Sprintf("      maxSize: %s\n", ip.MaxSize))
-	strB.WriteString(fmt.Sprintf("      interpolation: %s", ip.Interpolation))
+	strB.WriteString(fmt.Sprintf("      interpolation: %s\n", ip.Interpolation))
+	strB.WriteString(fmt.Sprintf("      metadata: %s\n", ip.Metadata))
+	strB.WriteString(fmt.Sprintf("      fit: %s\n", ip.Fit))
+	strB.WriteString(fmt.Sprintf("      background: %v\n", ip.Background))
+	strB.WriteString(fmt.Sprintf("      dominantBackground: %t\n", ip.DominantBackground))
+	strB.WriteString(fmt.Sprintf("      dither: %s\n", ip.Dither))
+	strB.WriteString(fmt.Sprintf("      rotate: %s\n", ip.Rotate))
+	strB.WriteString(fmt.Sprintf("      flip: %s\n", ip.Flip))
+	strB.WriteString(fmt.Sprintf("      filters: %+v\n", ip.Filters))
+	strB.WriteString(fmt.Sprintf("      watermark: %+v\n", ip.Watermark))
+	strB.WriteString(fmt.Sprintf("      caption: %+v", ip.Caption))
 	return strB.String()
 }
 
@@ -765,17 +1328,32 @@ func optionsDefault() options {
 			Format:      Jpeg,
 			QualityJpeg: 80,
 			QualityGif:  256,
+			QualityWebp: 80,
+			QualityPng:  6,
+			QualityPng8: 256,
 			Width:       0,
 			Height:      800,
 			MaxSize:     10 * size.Megabyte,
+
+			Interpolation: Lanczos3,
+			Metadata:      MetadataStrip,
+			Fit:           FitCover,
+			Dither:        DitherFloydSteinberg,
 		},
 
 		imagePresets: []ImagePreset{},
 	}
 }
 
+// presetsMap returns the presets by name and alias. Aliases take precedence
+// over names of other presets.
 func presetsMap(imagePresets []ImagePreset) map[string]ImagePreset {
 	m := make(map[string]ImagePreset)
+	for _, p := range imagePresets {
+		if p.Name != "" {
+			m[p.Name] = p
+		}
+	}
 	for _, p := range imagePresets {
 		for _, a := range p.Alias {
 			m[a] = p
@@ -821,6 +1399,33 @@ func WithSetPermissions(b bool) optFunc {
 	}
 }
 
+// WithBakeOrientation sets wether originals should be rotated and flipped
+// according to their exif orientation when added
+func WithBakeOrientation(b bool) optFunc {
+	return func(o *options) error {
+		o.bakeOrientation = b
+		return nil
+	}
+}
+
+// WithScrubGps sets wether location data should be removed from the exif
+// data of originals when added
+func WithScrubGps(b bool) optFunc {
+	return func(o *options) error {
+		o.scrubGps = b
+		return nil
+	}
+}
+
+// WithDedupe sets wether adding a file identical to a stored original
+// returns the id of that original instead of a new one
+func WithDedupe(b bool) optFunc {
+	return func(o *options) error {
+		o.dedupe = b
+		return nil
+	}
+}
+
 // WithOriginalsDir sets the originals directory
 func WithOriginalsDir(dir string) optFunc {
 	return func(o *options) error {
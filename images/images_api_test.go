@@ -1,8 +1,20 @@
 package images_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/charmbracelet/log"
@@ -13,7 +25,7 @@ import (
 const (
 	testFsDir          = "test-fs"
 	test_import_source = testFsDir + "/originals"
-	commonExt          = ".jpeg" // this needs to be  the same as in images.go
+	commonExt          = ".jpeg" // extension of jpeg originals
 )
 
 func Test_Add(t *testing.T) {
@@ -154,6 +166,1425 @@ func Test_Get(t *testing.T) {
 	}
 }
 
+func Test_Get_MaxSize(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testGetMaxSize-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testGetMaxSize-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+
+	// act
+	maxSize := size.S(10 * size.Kilobyte)
+	path, err := ih.Get(images.ImageParameters{
+		Id:      id,
+		Width:   400,
+		Height:  400,
+		Format:  images.Jpeg,
+		Quality: 100,
+		MaxSize: maxSize,
+	})
+
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.S(stat.Size()) > maxSize {
+		t.Fatalf("file is larger than max size. got %s, want at most %s", size.S(stat.Size()), maxSize)
+	}
+}
+
+func Test_Webp(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testWebp-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testWebp-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/six.png")
+
+	// act: encode as webp, lossy and lossless
+	lossy, err := ih.Get(images.ImageParameters{Id: id, Width: 200, Format: images.Webp, Quality: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossless, err := ih.Get(images.ImageParameters{Id: id, Width: 200, Format: images.Webp, Lossless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	for _, path := range []string{lossy, lossless} {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf, format, err := image.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != "webp" {
+			t.Errorf("expected webp, got %s (%s)", format, path)
+		}
+		if conf.Width != 200 {
+			t.Errorf("expected width 200, got %d (%s)", conf.Width, path)
+		}
+	}
+	if lossy == lossless {
+		t.Errorf("lossy and lossless variants share cache path %s", lossy)
+	}
+
+	// act: add the webp as a new original
+	file, err := os.Open(lossy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	webpId, err := ih.Add(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ih.Get(images.ImageParameters{Id: webpId, Width: 100, Format: images.Jpeg})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Png8(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testPng8-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testPng8-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/six.png")
+
+	// act
+	full, err := ih.Get(images.ImageParameters{Id: id, Width: 200, Format: images.Png})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := ih.Get(images.ImageParameters{Id: id, Width: 200, Format: images.Png8, Quality: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err := os.Open(indexed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" {
+		t.Errorf("expected png, got %s (%s)", format, indexed)
+	}
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("expected a paletted image, got %T", img)
+	}
+	if len(paletted.Palette) > 32 {
+		t.Errorf("expected at most 32 colors, got %d", len(paletted.Palette))
+	}
+	if img.Bounds().Dx() != 200 {
+		t.Errorf("expected width 200, got %d", img.Bounds().Dx())
+	}
+
+	fullStat, err := os.Stat(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexedStat, err := os.Stat(indexed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexedStat.Size() >= fullStat.Size() {
+		t.Errorf("expected png8 (%d bytes) to be smaller than png (%d bytes)", indexedStat.Size(), fullStat.Size())
+	}
+}
+
+func Test_GifPalette(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testGifPalette-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testGifPalette-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two colors that are not in any fixed palette
+	orig := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(orig, image.Rect(0, 0, 20, 20), image.NewUniform(color.RGBA{200, 120, 30, 255}), image.Point{}, draw.Src)
+	draw.Draw(orig, image.Rect(20, 0, 40, 20), image.NewUniform(color.RGBA{30, 90, 160, 255}), image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ih.Add(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act & assert
+	paths := map[string]bool{}
+	for _, dither := range []images.Dither{images.DitherNone, images.DitherFloydSteinberg, images.DitherOrdered} {
+		path, err := ih.Get(images.ImageParameters{Id: id, Width: 40, Format: images.Gif, Quality: 16, Dither: dither})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[path] = true
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := gif.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.RGBAModel.Convert(img.At(5, 5)); got != (color.RGBA{200, 120, 30, 255}) {
+			t.Errorf("dither %s: expected the exact color of the original, got %v", dither, got)
+		}
+		if p := img.(*image.Paletted).Palette; len(p) > 16 {
+			t.Errorf("dither %s: expected at most 16 colors, got %d", dither, len(p))
+		}
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected a cache file per dither, got %v", paths)
+	}
+}
+
+func Test_AnimatedGif(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testAnimated-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testAnimated-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three frames of a single color each
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}}
+	anim := &gif.GIF{LoopCount: 3}
+	for i := range palette {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+	buf := &bytes.Buffer{}
+	err = gif.EncodeAll(buf, anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ih.Add(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act: resize the animation
+	path, err := ih.Get(images.ImageParameters{Id: id, Width: 20, Format: images.Gif})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gif.DecodeAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(got.Image))
+	}
+	if got.Config.Width != 20 || got.Config.Height != 10 {
+		t.Errorf("expected 20x10, got %dx%d", got.Config.Width, got.Config.Height)
+	}
+	if got.LoopCount != 3 {
+		t.Errorf("expected loop count 3, got %d", got.LoopCount)
+	}
+	for i, d := range got.Delay {
+		if d != anim.Delay[i] {
+			t.Errorf("frame %d: expected delay %d, got %d", i, anim.Delay[i], d)
+		}
+	}
+
+	// act: pick a single frame
+	path, err = ih.Get(images.ImageParameters{Id: id, Width: 20, Format: images.Png, Frame: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(10, 5).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+		t.Errorf("expected frame 3 to be red, got %v", img.At(10, 5))
+	}
+
+	// act: crop the animation
+	path, err = ih.Get(images.ImageParameters{Id: id, Width: 10, Format: images.Gif, Crop: images.Crop{X: 50, Y: 0, W: 50, H: 100, Percent: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = gif.DecodeAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(got.Image))
+	}
+	if got.Config.Width != 10 || got.Config.Height != 10 {
+		t.Errorf("expected 10x10, got %dx%d", got.Config.Width, got.Config.Height)
+	}
+
+	// act: pick a frame of a jpeg
+	jpegId := addOrig(t, ih, test_import_source+"/one.jpg")
+	_, err = ih.Get(images.ImageParameters{Id: jpegId, Width: 20, Frame: 2})
+
+	// assert
+	if !errors.Is(err, images.ErrInvalidFrame{}) {
+		t.Errorf("expected ErrInvalidFrame, got %v", err)
+	}
+}
+
+func Test_Crop(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testCrop-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testCrop-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+
+	// act
+	path, err := ih.Get(images.ImageParameters{Id: id, Width: 60, Format: images.Png, Crop: images.Crop{X: 10, Y: 20, W: 120, H: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ratio of the crop is kept
+	if img.Bounds().Dx() != 60 || img.Bounds().Dy() != 30 {
+		t.Errorf("expected 60x30, got %v", img.Bounds().Size())
+	}
+
+	// act: rotate the crop
+	path, err = ih.Get(images.ImageParameters{Id: id, Width: 30, Format: images.Png, Crop: images.Crop{X: 10, Y: 20, W: 120, H: 60}, Rotate: images.Rotate90, Flip: images.FlipH})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = png.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 30 || img.Bounds().Dy() != 60 {
+		t.Errorf("expected 30x60, got %v", img.Bounds().Size())
+	}
+
+	// act: crop outside of the original
+	_, err = ih.Get(images.ImageParameters{Id: id, Format: images.Png, Crop: images.Crop{X: 10, Y: 20, W: 100000, H: 60}})
+
+	// assert
+	if !errors.Is(err, images.ErrInvalidCrop{}) {
+		t.Errorf("expected ErrInvalidCrop, got %v", err)
+	}
+}
+
+func Test_SetFocus(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testFocus-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testFocus-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	newHandler := func() (*images.ImageHandler, error) {
+		return images.New(
+			images.WithOriginalsDir(originalsDir),
+			images.WithCacheDir(cachePath),
+			images.WithSetPermissions(true),
+			images.WithCreateDirs(true),
+			images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+			images.WithLogLevel("debug"),
+		)
+	}
+	ih, err := newHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+	square := images.ImageParameters{Id: id, Width: 50, Height: 50, Format: images.Png}
+
+	centered, err := ih.Get(square)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	err = ih.SetFocus(id, images.FocalPoint{X: 0, Y: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	focused, err := ih.Get(square)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	if focused == centered {
+		t.Errorf("expected a new cache file after changing the focal point, got %s", focused)
+	}
+	stat, err := ih.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Cache.NumItems != 1 {
+		t.Errorf("expected old variants to be removed from the cache, got %d items", stat.Cache.NumItems)
+	}
+	fp, err := ih.Focus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp != (images.FocalPoint{X: 0, Y: 0}) {
+		t.Errorf("expected focal point (0, 0), got %v", fp)
+	}
+
+	err = ih.SetFocus(id, images.FocalPoint{X: 1.5, Y: 0})
+	if !errors.Is(err, images.ErrInvalidFocalPoint{}) {
+		t.Errorf("expected ErrInvalidFocalPoint, got %v", err)
+	}
+
+	// focal point survives a restart
+	ih, err = newHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err = ih.Focus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp != (images.FocalPoint{X: 0, Y: 0}) {
+		t.Errorf("expected focal point (0, 0) after restart, got %v", fp)
+	}
+}
+
+func Test_Placeholder(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testPlaceholder-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testPlaceholder-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	newHandler := func() (*images.ImageHandler, error) {
+		return images.New(
+			images.WithOriginalsDir(originalsDir),
+			images.WithCacheDir(cachePath),
+			images.WithSetPermissions(true),
+			images.WithCreateDirs(true),
+			images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+			images.WithLogLevel("debug"),
+		)
+	}
+	ih, err := newHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+
+	// act
+	p, err := ih.Placeholder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	if len(p.BlurHash) != 28 {
+		t.Errorf("expected a blurhash of 28 characters, got %s", p.BlurHash)
+	}
+	if !strings.HasPrefix(p.DataUri, "data:image/jpeg;base64,") {
+		t.Errorf("expected a jpeg data uri, got %.40s", p.DataUri)
+	}
+	sc, err := os.ReadFile(filepath.Join(originalsDir, strconv.Itoa(id)+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sc), p.BlurHash) {
+		t.Errorf("expected the placeholder to be stored with the original, got %s", sc)
+	}
+
+	// stored placeholders survive a restart
+	ih, err = newHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ih.Placeholder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != p {
+		t.Errorf("expected %+v after restart, got %+v", p, stored)
+	}
+
+	err = ih.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ih.Placeholder(id)
+	if !errors.Is(err, images.ErrIdNotFound{}) {
+		t.Errorf("expected ErrIdNotFound after delete, got %v", err)
+	}
+}
+
+func Test_Colors(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testColors-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testColors-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// left three quarters red, right quarter blue. Small enough to not be
+	// downscaled, which would blend the two.
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(75, 0, 100, 50), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ih.Add(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	c, err := ih.Colors(id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	if c.Dominant != "#ff0000" || len(c.Palette) != 2 || c.Palette[1].Color != "#0000ff" {
+		t.Errorf("expected red dominant and a blue second color, got %+v", c)
+	}
+	sc, err := os.ReadFile(filepath.Join(originalsDir, strconv.Itoa(id)+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sc), "#0000ff") {
+		t.Errorf("expected the colors to be stored with the original, got %s", sc)
+	}
+
+	_, err = ih.Colors(id, images.MaxPaletteSize+1)
+	if !errors.Is(err, images.ErrInvalidPaletteSize{}) {
+		t.Errorf("expected ErrInvalidPaletteSize, got %v", err)
+	}
+
+	// dominant color as background
+	path, err := ih.Get(images.ImageParameters{Id: id, Width: 100, Height: 100, Fit: images.FitContain, DominantBackground: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(filepath.Base(path), "_bgff0000ff") {
+		t.Errorf("expected the dominant color in the cache key, got %s", path)
+	}
+}
+
+func Test_Add_dedupe(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testDedupe-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testDedupe-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	newHandler := func(dedupe bool) (*images.ImageHandler, error) {
+		return images.New(
+			images.WithOriginalsDir(originalsDir),
+			images.WithCacheDir(cachePath),
+			images.WithSetPermissions(true),
+			images.WithCreateDirs(true),
+			images.WithDedupe(dedupe),
+			images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+			images.WithLogLevel("debug"),
+		)
+	}
+	add := func(ih *images.ImageHandler, path string) (int, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		return ih.Add(file)
+	}
+
+	ih, err := newHandler(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := addOrig(t, ih, test_import_source+"/one.jpg")
+
+	// without dedupe every file gets a new id
+	second := addOrig(t, ih, test_import_source+"/one.jpg")
+	if second == first {
+		t.Errorf("expected a new id without dedupe, got %d twice", first)
+	}
+	sc, err := os.ReadFile(filepath.Join(originalsDir, strconv.Itoa(first)+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sc), `"sha256"`) {
+		t.Errorf("expected the hash to be stored with the original, got %s", sc)
+	}
+
+	// hashes missing from earlier versions are computed on start
+	err = os.Remove(filepath.Join(originalsDir, strconv.Itoa(first)+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ih, err = newHandler(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	id, err := add(ih, test_import_source+"/one.jpg")
+
+	// assert
+	if !errors.Is(err, images.ErrDuplicate{}) || id != first {
+		t.Errorf("expected ErrDuplicate and id %d, got %d and %v", first, id, err)
+	}
+	other := addOrig(t, ih, test_import_source+"/two.jpg")
+	if other == first || other == second {
+		t.Errorf("expected a new id for a different file, got %d", other)
+	}
+
+	// deleted originals are not returned
+	for _, id := range []int{first, second} {
+		err = ih.Delete(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err = add(ih, test_import_source+"/one.jpg")
+	if err != nil || id <= other {
+		t.Errorf("expected a new id after delete, got %d and %v", id, err)
+	}
+}
+
+func Test_Add_dedupeConcurrent(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testDedupeConcurrent-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testDedupeConcurrent-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithDedupe(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(test_import_source + "/one.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act: identical uploads at the same time
+	const uploads = 8
+	ids := make([]int, uploads)
+	errs := make([]error, uploads)
+	wg := sync.WaitGroup{}
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = ih.Add(bytes.NewReader(data))
+		}(i)
+	}
+	wg.Wait()
+
+	// assert: one is stored, the others are duplicates of it
+	stored := 0
+	for i, err := range errs {
+		if err == nil {
+			stored++
+		} else if !errors.Is(err, images.ErrDuplicate{}) {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+		if ids[i] != ids[0] {
+			t.Errorf("expected every upload to get id %d, got %d", ids[0], ids[i])
+		}
+	}
+	if stored != 1 {
+		t.Errorf("expected 1 stored upload, got %d", stored)
+	}
+	all, err := ih.Ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("expected 1 original, got %v", all)
+	}
+}
+
+func Test_Similar(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testSimilar-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testSimilar-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+	for _, name := range []string{"two.jpg", "three.jpg", "four.jpg", "five.jpg", "six.png"} {
+		addOrig(t, ih, test_import_source+"/"+name)
+	}
+
+	// a resized and re-encoded copy
+	path, err := ih.Get(images.ImageParameters{Id: id, Width: 300, Format: images.Webp, Quality: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyId := addOrig(t, ih, path)
+
+	// act
+	got, err := ih.Similar(id, images.DefaultSimilarDistance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	if len(got) != 1 || got[0].Id != copyId {
+		t.Errorf("expected only the copy (id %d) to be similar, got %+v", copyId, got)
+	}
+	all, err := ih.Similar(id, images.MaxHashDistance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 || all[0].Id != copyId {
+		t.Errorf("expected all other originals closest first, got %+v", all)
+	}
+	for i := 1; i < len(all); i++ {
+		prev := all[i-1]
+		if all[i].Distance < prev.Distance || (all[i].Distance == prev.Distance && all[i].Id < prev.Id) {
+			t.Errorf("expected results ordered by distance and id, got %+v", all)
+		}
+	}
+
+	_, err = ih.Similar(id, images.MaxHashDistance+1)
+	if !errors.Is(err, images.ErrInvalidDistance{}) {
+		t.Errorf("expected ErrInvalidDistance, got %v", err)
+	}
+	_, err = ih.Similar(9999, images.DefaultSimilarDistance)
+	if !errors.Is(err, images.ErrIdNotFound{}) {
+		t.Errorf("expected ErrIdNotFound, got %v", err)
+	}
+
+	// hashes missing from earlier versions are computed on start
+	scPath := filepath.Join(originalsDir, strconv.Itoa(id)+".json")
+	err = os.Remove(scPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := os.ReadFile(scPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sc), `"dhash"`) {
+		t.Errorf("expected the perceptual hash to be stored on start, got %s", sc)
+	}
+}
+
+func Test_Info(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testInfo-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testInfo-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	newHandler := func() (*images.ImageHandler, error) {
+		return images.New(
+			images.WithOriginalsDir(originalsDir),
+			images.WithCacheDir(cachePath),
+			images.WithSetPermissions(true),
+			images.WithCreateDirs(true),
+			images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+			images.WithLogLevel("debug"),
+		)
+	}
+	ih, err := newHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/six.png")
+
+	// act
+	info, err := ih.Info(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	if info.Width != 962 || info.Height != 1024 || info.Format != images.Png || !info.Alpha || info.Frames != 1 {
+		t.Errorf("expected a 962x1024 png with alpha, got %+v", info)
+	}
+	sc, err := os.ReadFile(filepath.Join(originalsDir, strconv.Itoa(id)+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sc), `"width": 962`) {
+		t.Errorf("expected the info to be stored with the original when added, got %s", sc)
+	}
+
+	// stored info survives a restart
+	ih, err = newHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ih.Info(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != info {
+		t.Errorf("expected %+v after restart, got %+v", info, stored)
+	}
+
+	_, err = ih.Info(9999)
+	if !errors.Is(err, images.ErrIdNotFound{}) {
+		t.Errorf("expected ErrIdNotFound, got %v", err)
+	}
+}
+
+func Test_Sheet(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testSheet-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testSheet-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colors := []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+	ids := []int{}
+	for _, c := range colors {
+		img := image.NewNRGBA(image.Rect(0, 0, 60, 40))
+		draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+		buf := &bytes.Buffer{}
+		err = png.Encode(buf, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := ih.Add(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	sp := images.SheetParameters{Ids: ids, Cols: 2, CellWidth: 30, CellHeight: 20, Format: images.Png}
+
+	// act
+	path, cells, err := ih.Sheet(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sheet, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet.Bounds().Size() != image.Pt(60, 40) {
+		t.Errorf("expected a 60x40 sheet, got %v", sheet.Bounds().Size())
+	}
+	if len(cells) != 3 {
+		t.Fatalf("expected 3 cells, got %+v", cells)
+	}
+	for i, cell := range cells {
+		got := color.NRGBAModel.Convert(sheet.At(cell.X+cell.Width/2, cell.Y+cell.Height/2))
+		if got != colors[i] {
+			t.Errorf("expected cell %d (%+v) to be %v, got %v", i, cell, colors[i], got)
+		}
+	}
+	// the empty cell is transparent
+	if _, _, _, a := sheet.At(45, 30).RGBA(); a != 0 {
+		t.Errorf("expected the unused cell to be transparent, alpha %d", a)
+	}
+
+	cached, _, err := ih.Sheet(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != path {
+		t.Errorf("expected the cached sheet %s, got %s", path, cached)
+	}
+
+	// ids given more than once fill every cell they are given for
+	repeated, cells, err := ih.Sheet(images.SheetParameters{Ids: []int{ids[0], ids[1], ids[0]}, Cols: 3, CellWidth: 30, CellHeight: 20, Format: images.Png})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = os.Open(repeated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet, err = png.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []color.NRGBA{colors[0], colors[1], colors[0]} {
+		if got := color.NRGBAModel.Convert(sheet.At(cells[i].X+15, cells[i].Y+10)); got != want {
+			t.Errorf("expected repeated cell %d to be %v, got %v", i, want, got)
+		}
+	}
+
+	err = ih.Delete(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ih.Sheet(sp)
+	if !errors.Is(err, images.ErrIdNotFound{}) {
+		t.Errorf("expected ErrIdNotFound for a deleted id, got %v", err)
+	}
+	_, _, err = ih.Sheet(images.SheetParameters{Ids: ids[:2]})
+	if !errors.Is(err, images.ErrInvalidSheet{}) {
+		t.Errorf("expected ErrInvalidSheet without a cell size, got %v", err)
+	}
+}
+
+func Test_Sheet_manyIds(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testSheetMany-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testSheetMany-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more images than are rendered at once
+	n := runtime.NumCPU() + 2
+	if n > images.MaxSheetImages {
+		n = images.MaxSheetImages
+	}
+	colors := []color.NRGBA{}
+	ids := []int{}
+	for i := 0; i < n; i++ {
+		c := color.NRGBA{uint8(i * 255 / n), 0, uint8(255 - i*255/n), 255}
+		img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+		draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+		buf := &bytes.Buffer{}
+		err = png.Encode(buf, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := ih.Add(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		colors = append(colors, c)
+		ids = append(ids, id)
+	}
+
+	// act
+	path, cells, err := ih.Sheet(images.SheetParameters{Ids: ids, Cols: 10, CellWidth: 8, CellHeight: 8, Format: images.Png})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sheet, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cell := range cells {
+		got := color.NRGBAModel.Convert(sheet.At(cell.X+cell.Width/2, cell.Y+cell.Height/2))
+		if got != colors[i] {
+			t.Errorf("expected cell %d (%+v) to be %v, got %v", i, cell, colors[i], got)
+		}
+	}
+}
+
+func Test_Add_keepsFormat(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testAddFormat-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testAddFormat-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	id := addOrig(t, ih, test_import_source+"/six.png")
+
+	// assert
+	_, err = os.Stat(originalsDir + "/" + strconv.Itoa(id) + ".png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ih.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.ReadDir(originalsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir) != 0 {
+		t.Fatalf("expected originals dir to be empty after delete, found %d files", len(dir))
+	}
+}
+
+func Test_New_migratesOriginals(t *testing.T) {
+	t.Parallel()
+
+	// arange: a png stored with the legacy ".jpeg" extension
+	originalsDir, err := os.MkdirTemp(testFsDir, "testMigrate-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testMigrate-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	png, err := os.ReadFile(test_import_source + "/six.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(originalsDir+"/7"+commonExt, png, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	_, err = os.Stat(originalsDir + "/7.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ih.Ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 7 {
+		t.Fatalf("expected ids [7], got %v", ids)
+	}
+	_, err = ih.Get(images.ImageParameters{Id: 7, Width: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+	if id != 8 {
+		t.Fatalf("expected next id to be 8, got %d", id)
+	}
+}
+
+func Test_New_migrateKeepsExisting(t *testing.T) {
+	t.Parallel()
+
+	// arange: a png stored as "1.jpeg" next to a different png "1.png"
+	originalsDir, err := os.MkdirTemp(testFsDir, "testMigrateExisting-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testMigrateExisting-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	stored, err := os.ReadFile(test_import_source + "/six.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(originalsDir+"/1.png", stored, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &bytes.Buffer{}
+	err = png.Encode(legacy, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(originalsDir+"/1"+commonExt, legacy.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert: both files are left as they were
+	got, err := os.ReadFile(originalsDir + "/1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, stored) {
+		t.Fatal("expected 1.png to be kept")
+	}
+	_, err = os.Stat(originalsDir + "/1" + commonExt)
+	if err != nil {
+		t.Fatalf("expected legacy file to be kept, got %v", err)
+	}
+	ids, err := ih.Ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expected ids [1], got %v", ids)
+	}
+}
+
 // func Test_Remove(t *testing.T) {
 // 	// arange
 
@@ -281,3 +1712,168 @@ func addOrig(t *testing.T, ih *images.ImageHandler, path string) int {
 	}
 	return id
 }
+
+func Test_Watermark(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testWatermark-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testWatermark-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+
+	// solid red watermark
+	mark := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < len(mark.Pix); i += 4 {
+		mark.Pix[i], mark.Pix[i+3] = 255, 255
+	}
+	markPath := cachePath + "/watermark.png"
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(markPath, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// act
+	params := images.ImageParameters{Id: id, Width: 100, Format: images.Png, Watermark: images.Watermark{Path: markPath, Gravity: images.GravityNorthWest}}
+	path, err := ih.Get(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.NRGBAModel.Convert(img.At(5, 5)).(color.NRGBA); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("expected the watermark in the top-left corner, got %v", c)
+	}
+	clean, err := ih.Get(images.ImageParameters{Id: id, Width: 100, Format: images.Png})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clean == path {
+		t.Errorf("expected watermarked and clean images to be cached separately, got %s", path)
+	}
+
+	// act: missing watermark file
+	params.Watermark.Path = cachePath + "/missing.png"
+	_, err = ih.Get(params)
+
+	// assert
+	if err == nil {
+		t.Error("expected an error for a missing watermark file")
+	}
+}
+
+func Test_Dpr(t *testing.T) {
+	t.Parallel()
+
+	// arange
+	originalsDir, err := os.MkdirTemp(testFsDir, "testDpr-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originalsDir)
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testDpr-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+
+	defaults := images.ImageDefaults{
+		Format:         images.Jpeg,
+		QualityJpeg:    80,
+		Height:         800,
+		Interpolation:  images.NearestNeighbor,
+		Metadata:       images.MetadataStrip,
+		Fit:            images.FitCover,
+		MaxDimension:   300,
+		DprCapOriginal: true,
+	}
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithImageDefaults(defaults),
+		images.WithLogger(log.New(os.Stderr).WithPrefix(t.Name())),
+		images.WithLogLevel("debug"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addOrig(t, ih, test_import_source+"/one.jpg")
+
+	// 200x100 original
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, image.NewGray(image.Rect(0, 0, 200, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := ih.Add(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		params images.ImageParameters
+		want   image.Point
+	}{
+		{"multiplied", images.ImageParameters{Id: id, Width: 50, Height: 40, Dpr: 2}, image.Pt(100, 80)},
+		{"original reached", images.ImageParameters{Id: small, Width: 50, Dpr: 4}, image.Pt(200, 0)},
+		{"original exceeded", images.ImageParameters{Id: small, Width: 250, Dpr: 2}, image.Pt(250, 0)},
+		{"crop reached", images.ImageParameters{Id: small, Width: 25, Dpr: 4, Crop: images.Crop{W: 50, H: 50}}, image.Pt(50, 0)},
+		{"rotated original reached", images.ImageParameters{Id: small, Width: 50, Dpr: 4, Rotate: images.Rotate90}, image.Pt(100, 0)},
+		{"fraction", images.ImageParameters{Id: id, Width: 100, Dpr: 1.5}, image.Pt(150, 0)},
+		{"capped", images.ImageParameters{Id: id, Width: 100, Height: 50, Dpr: 4}, image.Pt(300, 150)},
+		{"capped without dpr", images.ImageParameters{Id: id, Height: 1000}, image.Pt(0, 300)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// act
+			path, err := ih.Get(tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// assert
+			wantPrefix := fmt.Sprintf("%d_%dx%d_", tt.params.Id, tt.want.X, tt.want.Y)
+			if !strings.HasPrefix(filepath.Base(path), wantPrefix) {
+				t.Errorf("expected a cache file starting with %s, got %s", wantPrefix, filepath.Base(path))
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package images
 
 import (
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math/rand"
 	"testing"
 
 	"github.com/johan-st/go-image-server/units/size"
+	"github.com/nfnt/resize"
 )
 
 func TestSize_String(t *testing.T) {
@@ -44,7 +51,10 @@ func TestFormat_String(t *testing.T) {
 	}{
 		{"Jpeg", Jpeg, "jpeg"},
 		{"png", Png, "png"},
+		{"png8", Png8, "png8"},
 		{"gif", Gif, "gif"},
+		{"webp", Webp, "webp"},
+		{"auto", Auto, "auto"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -58,12 +68,26 @@ func TestFormat_String(t *testing.T) {
 func TestImageParameters_String(t *testing.T) {
 	t.Parallel()
 	type fields struct {
-		Id      int
-		Format  Format
-		Width   uint
-		Height  uint
-		Quality int
-		MaxSize size.S
+		Id            int
+		Format        Format
+		Width         uint
+		Height        uint
+		Quality       int
+		Lossless      bool
+		Dither        Dither
+		MaxSize       size.S
+		Interpolation Interpolation
+		Metadata      Metadata
+		Frame         uint
+		Fit           Fit
+		Background    color.NRGBA
+		BackgroundSet bool
+		Crop          Crop
+		Rotate        Rotation
+		Flip          Flip
+		Filters       Filters
+		Watermark     Watermark
+		Caption       Caption
 	}
 	tests := []struct {
 		name   string
@@ -72,6 +96,28 @@ func TestImageParameters_String(t *testing.T) {
 	}{
 		{"jpeg 100x100", fields{Id: 42, Format: Jpeg, Width: 100, Height: 100}, "42_100x100_q0_s0.jpeg"},
 		{"gif q256", fields{Id: 9, Format: Gif, Quality: 256}, "9_0x0_q256_s0.gif"},
+		{"webp lossless", fields{Id: 5, Format: Webp, Width: 10, Height: 10, Lossless: true}, "5_10x10_q0_s0_ll.webp"},
+		{"png8 64 colors", fields{Id: 5, Format: Png8, Width: 10, Quality: 64}, "5_10x0_q64_s0.png8"},
+		{"gif ordered", fields{Id: 9, Format: Gif, Quality: 16, Dither: DitherOrdered}, "9_0x0_q16_s0_dordered.gif"},
+		{"gif fs", fields{Id: 9, Format: Gif, Quality: 16, Dither: DitherFloydSteinberg}, "9_0x0_q16_s0.gif"},
+		{"jpeg ignores dither", fields{Id: 9, Format: Jpeg, Quality: 16, Dither: DitherNone}, "9_0x0_q16_s0.jpeg"},
+		{"nearest neighbor", fields{Id: 3, Format: Png, Width: 64, Interpolation: NearestNeighbor}, "3_64x0_q0_s0_inearestNeighbor.png"},
+		{"frame", fields{Id: 2, Format: Png, Width: 64, Frame: 3}, "2_64x0_q0_s0_f3.png"},
+		{"fit cover", fields{Id: 1, Format: Jpeg, Width: 64, Height: 64, Fit: FitCover}, "1_64x64_q0_s0.jpeg"},
+		{"fit contain", fields{Id: 1, Format: Png, Width: 64, Height: 64, Fit: FitContain}, "1_64x64_q0_s0_contain.png"},
+		{"fit contain bg", fields{Id: 1, Format: Jpeg, Width: 64, Height: 64, Fit: FitContain, Background: color.NRGBA{255, 0, 0, 255}}, "1_64x64_q0_s0_contain_bgff0000ff.jpeg"},
+		{"fit contain transparent", fields{Id: 1, Format: Jpeg, Width: 64, Height: 64, Fit: FitContain, BackgroundSet: true}, "1_64x64_q0_s0_contain_bg00000000.jpeg"},
+		{"fit fill", fields{Id: 1, Format: Jpeg, Width: 64, Height: 64, Fit: FitFill, Background: color.NRGBA{255, 0, 0, 255}}, "1_64x64_q0_s0_fill.jpeg"},
+		{"metadata strip", fields{Id: 4, Format: Jpeg, Width: 64, Metadata: MetadataStrip}, "4_64x0_q0_s0.jpeg"},
+		{"metadata nogps", fields{Id: 4, Format: Jpeg, Width: 64, Metadata: MetadataNoGps}, "4_64x0_q0_s0_mnogps.jpeg"},
+		{"crop pixels", fields{Id: 6, Format: Jpeg, Width: 64, Crop: Crop{X: 10, Y: 20, W: 300, H: 200}}, "6_64x0_q0_s0_c10-20-300-200.jpeg"},
+		{"rotate", fields{Id: 6, Format: Jpeg, Width: 64, Rotate: Rotate90}, "6_64x0_q0_s0_r90.jpeg"},
+		{"rotate flip", fields{Id: 6, Format: Jpeg, Width: 64, Rotate: Rotate270, Flip: FlipHV}, "6_64x0_q0_s0_r270_flhv.jpeg"},
+		{"filters", fields{Id: 7, Format: Png, Width: 64, Filters: Filters{Grayscale: true, Blur: 2.5, Sharpen: 1}}, "7_64x0_q0_s0_gray_bl2.5_sh1.png"},
+		{"adjustments", fields{Id: 7, Format: Png, Width: 64, Filters: Filters{Brightness: -10, Contrast: 20, Saturation: 30}}, "7_64x0_q0_s0_br-10_ct20_sa30.png"},
+		{"watermark", fields{Id: 8, Format: Jpeg, Width: 64, Watermark: Watermark{Path: "wm.png"}}, "8_64x0_q0_s0_wm" + Watermark{Path: "wm.png"}.key() + ".jpeg"},
+		{"caption", fields{Id: 8, Format: Jpeg, Width: 64, Caption: Caption{Text: "SAMPLE"}}, "8_64x0_q0_s0_t" + Caption{Text: "SAMPLE"}.key() + ".jpeg"},
+		{"crop percent", fields{Id: 6, Format: Jpeg, Width: 64, Crop: Crop{X: 12.5, Y: 0, W: 50, H: 50, Percent: true}}, "6_64x0_q0_s0_c12.5p-0p-50p-50p.jpeg"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -82,6 +128,21 @@ func TestImageParameters_String(t *testing.T) {
 				Height:  tt.fields.Height,
 				Quality: tt.fields.Quality,
 				MaxSize: tt.fields.MaxSize,
+
+				Lossless:      tt.fields.Lossless,
+				Dither:        tt.fields.Dither,
+				Interpolation: tt.fields.Interpolation,
+				Metadata:      tt.fields.Metadata,
+				Frame:         tt.fields.Frame,
+				Fit:           tt.fields.Fit,
+				Background:    tt.fields.Background,
+				BackgroundSet: tt.fields.BackgroundSet,
+				Crop:          tt.fields.Crop,
+				Rotate:        tt.fields.Rotate,
+				Flip:          tt.fields.Flip,
+				Filters:       tt.fields.Filters,
+				Watermark:     tt.fields.Watermark,
+				Caption:       tt.fields.Caption,
 			}
 			if got := ip.String(); got != tt.want {
 				t.Errorf("ImageParameters.String() = %v, want %v", got, tt.want)
@@ -204,3 +265,319 @@ func Test_ratioToPixels(t *testing.T) {
 		})
 	}
 }
+
+func Test_fitBudget(t *testing.T) {
+	t.Parallel()
+	img := noiseImage(300, 200)
+
+	tests := []struct {
+		name    string
+		format  Format
+		quality int
+		budget  size.S
+		wantErr bool
+	}{
+		{"no limit", Jpeg, 80, 0, false},
+		{"jpeg lower quality", Jpeg, 100, 40 * size.Kilobyte, false},
+		{"jpeg scale down", Jpeg, 80, 3 * size.Kilobyte, false},
+		{"png scale down", Png, 0, 20 * size.Kilobyte, false},
+		{"gif fewer colors", Gif, 256, 30 * size.Kilobyte, false},
+		{"png8 fewer colors", Png8, 256, 20 * size.Kilobyte, false},
+		{"webp lower quality", Webp, 100, 20 * size.Kilobyte, false},
+		{"impossible", Png, 0, 10, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			params := ImageParameters{Format: tt.format, Quality: tt.quality}
+			qMin, qMax := qualityRange(params)
+			data, err := fitBudget(tt.budget, img.Bounds().Size(), qMin, qMax, func(w io.Writer, quality int, scale float64) error {
+				scaled := resize.Resize(uint(300*scale), 0, img, resize.Bilinear)
+				params.Quality = quality
+				return encodeImage(w, scaled, params)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fitBudget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrMaxSize{}) {
+					t.Errorf("fitBudget() error = %v, want ErrMaxSize", err)
+				}
+				return
+			}
+			if tt.budget != 0 && size.S(len(data)) > tt.budget {
+				t.Errorf("fitBudget() size = %s, want at most %s", size.S(len(data)), tt.budget)
+			}
+		})
+	}
+}
+
+// noiseImage returns an image that does not compress well.
+func noiseImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rnd := rand.New(rand.NewSource(42))
+	rnd.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+func Test_gifFrame(t *testing.T) {
+	t.Parallel()
+	palette := color.Palette{color.Transparent, color.White, color.Black}
+
+	// full white frame, then a black square that is disposed to background
+	// and a frame that only covers the top-left pixel
+	first := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+	for i := range first.Pix {
+		first.Pix[i] = 1
+	}
+	second := image.NewPaletted(image.Rect(2, 2, 4, 4), palette)
+	for i := range second.Pix {
+		second.Pix[i] = 2
+	}
+	third := image.NewPaletted(image.Rect(0, 0, 1, 1), palette)
+	anim := &gif.GIF{
+		Image:    []*image.Paletted{first, second, third},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 4, Height: 4},
+	}
+
+	tests := []struct {
+		frame uint
+		at    image.Point
+		want  color.Color
+	}{
+		{1, image.Pt(3, 3), color.White},
+		{2, image.Pt(3, 3), color.Black},
+		{3, image.Pt(3, 3), color.Transparent},
+		{3, image.Pt(1, 1), color.White},
+		{9, image.Pt(3, 3), color.Transparent}, // clamped to the last frame
+	}
+	for _, tt := range tests {
+		got := gifFrame(anim, tt.frame).At(tt.at.X, tt.at.Y)
+		if color.RGBAModel.Convert(got) != color.RGBAModel.Convert(tt.want) {
+			t.Errorf("gifFrame(%d) at %v = %v, want %v", tt.frame, tt.at, got, tt.want)
+		}
+	}
+}
+
+func Test_fitImage(t *testing.T) {
+	t.Parallel()
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	red := color.NRGBA{255, 0, 0, 255}
+
+	tests := []struct {
+		fit           Fit
+		width, height uint
+		want          image.Point
+	}{
+		{FitCover, 50, 50, image.Pt(50, 50)},
+		{FitContain, 50, 50, image.Pt(50, 50)},
+		{FitFill, 50, 50, image.Pt(50, 50)},
+		{FitInside, 50, 50, image.Pt(50, 25)},
+		{FitInside, 400, 400, image.Pt(200, 100)},
+		{FitInside, 0, 50, image.Pt(100, 50)},
+		{FitContain, 100, 0, image.Pt(100, 50)},
+	}
+	for _, tt := range tests {
+		got := fitImage(img, tt.width, tt.height, fitOptions{fit: tt.fit, bg: red, focus: focusCenter, interp: resize.Bilinear})
+		if got.Bounds().Size() != tt.want {
+			t.Errorf("fitImage(%s, %dx%d) size = %v, want %v", tt.fit, tt.width, tt.height, got.Bounds().Size(), tt.want)
+		}
+	}
+
+	// contain pads top and bottom, keeping the whole image
+	got := fitImage(img, 50, 50, fitOptions{fit: FitContain, bg: red, focus: focusCenter, interp: resize.Bilinear})
+	if c := color.NRGBAModel.Convert(got.At(25, 2)); c != red {
+		t.Errorf("fitImage(contain) padding = %v, want %v", c, red)
+	}
+	if c := color.NRGBAModel.Convert(got.At(25, 25)); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("fitImage(contain) center = %v, want white", c)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		s       string
+		want    color.NRGBA
+		wantErr bool
+	}{
+		{"fff", color.NRGBA{255, 255, 255, 255}, false},
+		{"#102030", color.NRGBA{0x10, 0x20, 0x30, 255}, false},
+		{"10203040", color.NRGBA{0x10, 0x20, 0x30, 0x40}, false},
+		{"red", color.NRGBA{}, true},
+		{"12345", color.NRGBA{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseColor(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseColor(%q) error = %v, wantErr %t", tt.s, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseColor(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func Test_cropRect(t *testing.T) {
+	t.Parallel()
+	bounds := image.Rect(0, 0, 200, 100)
+	tests := []struct {
+		name  string
+		focus FocalPoint
+		want  image.Rectangle
+	}{
+		{"center", focusCenter, image.Rect(50, 0, 150, 100)},
+		{"left", FocalPoint{X: 0.3, Y: 0.5}, image.Rect(10, 0, 110, 100)},
+		{"clamped left", FocalPoint{X: 0, Y: 0}, image.Rect(0, 0, 100, 100)},
+		{"clamped right", FocalPoint{X: 0.9, Y: 1}, image.Rect(100, 0, 200, 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cropRect(bounds, 1, 1, tt.focus); got != tt.want {
+				t.Errorf("cropRect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		s       string
+		want    Crop
+		wantErr bool
+	}{
+		{"10,20,300,200", Crop{X: 10, Y: 20, W: 300, H: 200}, false},
+		{"10%, 20%, 50%, 12.5%", Crop{X: 10, Y: 20, W: 50, H: 12.5, Percent: true}, false},
+		{"10,20,300", Crop{}, true},
+		{"10%,20,30,40", Crop{}, true},
+		{"10.5,20,30,40", Crop{}, true},
+		{"-10,20,30,40", Crop{}, true},
+		{"0,0,0,40", Crop{}, true},
+		{"a,b,c,d", Crop{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCrop(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCrop(%q) error = %v, wantErr %t", tt.s, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseCrop(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCrop_rect(t *testing.T) {
+	t.Parallel()
+	bounds := image.Rect(0, 0, 200, 100)
+	tests := []struct {
+		name    string
+		crop    Crop
+		want    image.Rectangle
+		wantErr bool
+	}{
+		{"pixels", Crop{X: 10, Y: 20, W: 50, H: 30}, image.Rect(10, 20, 60, 50), false},
+		{"whole image", Crop{W: 200, H: 100}, bounds, false},
+		{"percent", Crop{X: 25, Y: 50, W: 50, H: 50, Percent: true}, image.Rect(50, 50, 150, 100), false},
+		{"too wide", Crop{X: 150, Y: 0, W: 51, H: 10}, image.Rectangle{}, true},
+		{"too high", Crop{X: 0, Y: 10, W: 10, H: 100}, image.Rectangle{}, true},
+		{"percent too large", Crop{X: 60, Y: 0, W: 50, H: 10, Percent: true}, image.Rectangle{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.crop.rect(bounds)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Crop.rect() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidCrop{}) {
+				t.Errorf("Crop.rect() error = %v, want ErrInvalidCrop", err)
+			}
+			if got != tt.want {
+				t.Errorf("Crop.rect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cropImage(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	got, focus, err := cropImage(img, Crop{X: 100, Y: 0, W: 100, H: 50}, FocalPoint{X: 0.75, Y: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != image.Rect(100, 0, 200, 50) {
+		t.Errorf("cropImage() bounds = %v, want %v", got.Bounds(), image.Rect(100, 0, 200, 50))
+	}
+	// the focal point is clamped to the cropped image
+	if want := (FocalPoint{X: 0.5, Y: 1}); focus != want {
+		t.Errorf("cropImage() focus = %v, want %v", focus, want)
+	}
+}
+
+func Test_capDimensions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		width, height uint
+		max           uint
+		wantW, wantH  uint
+	}{
+		{"no limit", 5000, 3000, 0, 5000, 3000},
+		{"within", 400, 300, 500, 400, 300},
+		{"wide", 1000, 500, 500, 500, 250},
+		{"tall", 500, 1000, 500, 250, 500},
+		{"width only", 1000, 0, 500, 500, 0},
+		{"height only", 0, 2000, 500, 0, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := capDimensions(tt.width, tt.height, tt.max)
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("capDimensions() = %dx%d, want %dx%d", w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestParseDpr(t *testing.T) {
+	t.Parallel()
+	for s, want := range map[string]float64{"1": 1, "1.5": 1.5, "4": 4} {
+		if got, err := ParseDpr(s); err != nil || got != want {
+			t.Errorf("ParseDpr(%q) = %g, %v, want %g", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"0", "0.5", "4.5", "two", ""} {
+		if _, err := ParseDpr(s); err == nil {
+			t.Errorf("ParseDpr(%q) expected an error", s)
+		}
+	}
+}
+
+func TestImageParameters_applyBackground(t *testing.T) {
+	t.Parallel()
+	def := ImageDefaults{Background: color.NRGBA{255, 0, 0, 255}}
+
+	unset := ImageParameters{}
+	unset.apply(def)
+	if unset.Background != def.Background {
+		t.Errorf("apply() background = %v, want default %v", unset.Background, def.Background)
+	}
+
+	transparent := ImageParameters{BackgroundSet: true}
+	transparent.apply(def)
+	if transparent.Background != (color.NRGBA{}) {
+		t.Errorf("apply() background = %v, want transparent", transparent.Background)
+	}
+	if background(transparent) != (color.NRGBA{}) {
+		t.Errorf("background() = %v, want transparent", background(transparent))
+	}
+}
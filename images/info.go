@@ -0,0 +1,220 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"time"
+)
+
+// Info is technical metadata about an original.
+type Info struct {
+	// size in pixels, upright
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format Format `json:"format"`
+	// "ycbcr", "rgb", "gray", "paletted" or "cmyk"
+	ColorModel string `json:"colorModel"`
+	// bits per channel of the decoded pixels, 8 or 16
+	BitDepth int `json:"bitDepth"`
+	// true if any pixel is not fully opaque
+	Alpha bool `json:"alpha"`
+	// number of frames, 1 for still images
+	Frames int `json:"frames"`
+	// nil if the original has no exif data
+	Exif     *ExifSummary `json:"exif,omitempty"`
+	Uploaded time.Time    `json:"uploaded"`
+}
+
+// ExifSummary holds the commonly used exif fields of an original.
+type ExifSummary struct {
+	Make      string `json:"make,omitempty"`
+	Model     string `json:"model,omitempty"`
+	LensModel string `json:"lensModel,omitempty"`
+	Software  string `json:"software,omitempty"`
+	// local time the photo was taken, e.g. "2023-06-01T14:03:12"
+	Taken string `json:"taken,omitempty"`
+	// in seconds, e.g. "1/250"
+	ExposureTime string  `json:"exposureTime,omitempty"`
+	FNumber      float64 `json:"fNumber,omitempty"`
+	Iso          int     `json:"iso,omitempty"`
+	// in millimeters
+	FocalLength float64 `json:"focalLength,omitempty"`
+	Orientation int     `json:"orientation"`
+	Artist      string  `json:"artist,omitempty"`
+	Copyright   string  `json:"copyright,omitempty"`
+	// true if location data is present. The location itself is not given.
+	Gps bool `json:"gps"`
+}
+
+// Info returns technical metadata about the original with the given id. It
+// is read once, when the original is added, and stored with it.
+func (h *ImageHandler) Info(id int) (Info, error) {
+	path, format, err := h.original(id)
+	if err != nil {
+		return Info{}, err
+	}
+	sc, err := h.readSidecar(id)
+	if err != nil {
+		return Info{}, err
+	}
+	if sc.Info != nil {
+		return *sc.Info, nil
+	}
+
+	info, err := readInfo(path, format)
+	if err != nil {
+		return Info{}, err
+	}
+	err = h.updateSidecar(id, func(sc *sidecar) { sc.Info = &info })
+	if err != nil {
+		return Info{}, fmt.Errorf("could not store info: %w", err)
+	}
+	return info, nil
+}
+
+// readInfo decodes the image file at path and returns its metadata. The
+// upload time is the modification time of the file.
+func readInfo(path string, format Format) (Info, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Info{}, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Format: format, Frames: 1, Uploaded: stat.ModTime().UTC()}
+
+	if format == Gif {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return Info{}, err
+		}
+		canvas := gifCanvas(anim)
+		info.Width, info.Height = canvas.Dx(), canvas.Dy()
+		info.ColorModel, info.BitDepth = "paletted", 8
+		info.Frames = len(anim.Image)
+		for _, frame := range anim.Image {
+			info.Alpha = info.Alpha || !frame.Opaque()
+		}
+		return info, nil
+	}
+
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Info{}, err
+	}
+	info.Width, info.Height = conf.Width, conf.Height
+	info.ColorModel, info.BitDepth = colorModelOf(conf.ColorModel)
+	// only decoded if the color model can carry alpha
+	if hasAlphaChannel(conf.ColorModel) {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return Info{}, err
+		}
+		if o, ok := img.(interface{ Opaque() bool }); ok {
+			info.Alpha = !o.Opaque()
+		}
+	}
+
+	raw, err := readExif(bytes.NewReader(data))
+	if err != nil {
+		return info, nil
+	}
+	e, err := parseExif(raw)
+	if err != nil {
+		return info, nil
+	}
+	info.Exif = e.summary()
+	if info.Exif.Orientation >= orientTranspose {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info, nil
+}
+
+// colorModelOf returns the name of the color model m and its bits per
+// channel.
+func colorModelOf(m color.Model) (string, int) {
+	if _, ok := m.(color.Palette); ok {
+		return "paletted", 8
+	}
+	switch m {
+	case color.YCbCrModel, color.NYCbCrAModel:
+		return "ycbcr", 8
+	case color.GrayModel, color.AlphaModel:
+		return "gray", 8
+	case color.Gray16Model, color.Alpha16Model:
+		return "gray", 16
+	case color.CMYKModel:
+		return "cmyk", 8
+	case color.RGBA64Model, color.NRGBA64Model:
+		return "rgb", 16
+	}
+	return "rgb", 8
+}
+
+// hasAlphaChannel returns false for color models that are always opaque.
+func hasAlphaChannel(m color.Model) bool {
+	switch m {
+	case color.YCbCrModel, color.GrayModel, color.Gray16Model, color.CMYKModel:
+		return false
+	}
+	return true
+}
+
+// summary returns the commonly used fields of e.
+func (e *exifData) summary() *ExifSummary {
+	s := &ExifSummary{
+		Make:        e.ascii(e.ifd0, tagMake),
+		Model:       e.ascii(e.ifd0, tagModel),
+		LensModel:   e.ascii(e.exif, tagLensModel),
+		Software:    e.ascii(e.ifd0, tagSoftware),
+		Orientation: e.orientation(),
+		Artist:      e.ascii(e.ifd0, tagArtist),
+		Copyright:   e.ascii(e.ifd0, tagCopyright),
+		Gps:         len(e.gps) > 0,
+	}
+	if t, err := time.Parse("2006:01:02 15:04:05", e.ascii(e.exif, tagDateTimeOriginal)); err == nil {
+		s.Taken = t.Format("2006-01-02T15:04:05")
+	}
+	if entry, ok := find(e.exif, tagExposureTime); ok {
+		// a zero time can not be written as a fraction of a second
+		if num, den, ok := entry.rational(e.order); ok && den != 0 && num != 0 {
+			if num >= den {
+				s.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+			} else {
+				s.ExposureTime = fmt.Sprintf("1/%.0f", float64(den)/float64(num))
+			}
+		}
+	}
+	if entry, ok := find(e.exif, tagFNumber); ok {
+		if num, den, ok := entry.rational(e.order); ok && den != 0 {
+			s.FNumber = float64(num) / float64(den)
+		}
+	}
+	if entry, ok := find(e.exif, tagFocalLength); ok {
+		if num, den, ok := entry.rational(e.order); ok && den != 0 {
+			s.FocalLength = float64(num) / float64(den)
+		}
+	}
+	if entry, ok := find(e.exif, tagIso); ok {
+		if v, ok := entry.uint(e.order); ok {
+			s.Iso = int(v)
+		}
+	}
+	return s
+}
+
+// ascii returns the text of the ascii entry with the given tag, or "" if
+// there is none.
+func (e *exifData) ascii(entries []ifdEntry, tag uint16) string {
+	entry, ok := find(entries, tag)
+	if !ok || entry.typ != 2 {
+		return ""
+	}
+	return string(bytes.TrimSpace(bytes.TrimRight(entry.value, "\x00")))
+}
@@ -0,0 +1,127 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"testing"
+)
+
+func Test_readInfo(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	// jpeg rotated by exif, with camera data
+	e := testExif(binary.LittleEndian)
+	rationals := func(num, den uint32) []byte {
+		b := make([]byte, 8)
+		e.order.PutUint32(b, num)
+		e.order.PutUint32(b[4:], den)
+		return b
+	}
+	e.ifd0 = append(e.ifd0, ifdEntry{tag: tagModel, typ: 2, count: 5, value: []byte("X100\x00")})
+	e.exif = append(e.exif,
+		ifdEntry{tag: tagExposureTime, typ: 5, count: 1, value: rationals(10, 2500)},
+		ifdEntry{tag: tagFNumber, typ: 5, count: 1, value: rationals(28, 10)},
+	)
+	buf := &bytes.Buffer{}
+	err := encodeImageWithExif(buf, image.NewRGBA(image.Rect(0, 0, 80, 40)), ImageParameters{Format: Jpeg, Quality: 80}, e.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dir+"/1.jpeg", buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := readInfo(dir+"/1.jpeg", Jpeg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 40 || info.Height != 80 || info.Frames != 1 || info.Alpha || info.ColorModel != "ycbcr" || info.BitDepth != 8 {
+		t.Errorf("readInfo() = %+v, want an upright opaque 40x80 ycbcr image", info)
+	}
+	want := ExifSummary{
+		Model:        "X100",
+		Taken:        "2023-06-01T12:00:00",
+		ExposureTime: "1/250",
+		FNumber:      2.8,
+		Orientation:  orientRotate90,
+		Artist:       "Jane Doe",
+		Copyright:    "(c) Jane Doe",
+		Gps:          true,
+	}
+	if info.Exif == nil || *info.Exif != want {
+		t.Errorf("readInfo() exif = %+v, want %+v", info.Exif, want)
+	}
+	if info.Uploaded.IsZero() {
+		t.Error("readInfo() has no upload time")
+	}
+
+	// animated gif with a transparent color
+	palette := color.Palette{color.Transparent, color.White}
+	anim := &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 30, 20), palette), image.NewPaletted(image.Rect(0, 0, 30, 20), palette), image.NewPaletted(image.Rect(0, 0, 30, 20), palette)},
+		Delay:  []int{1, 1, 1},
+		Config: image.Config{Width: 30, Height: 20},
+	}
+	buf.Reset()
+	err = gif.EncodeAll(buf, anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dir+"/2.gif", buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = readInfo(dir+"/2.gif", Gif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 30 || info.Height != 20 || info.Frames != 3 || !info.Alpha || info.ColorModel != "paletted" || info.Exif != nil {
+		t.Errorf("readInfo() = %+v, want a transparent 30x20 gif with 3 frames", info)
+	}
+}
+
+func Test_exifSummary_exposureTime(t *testing.T) {
+	t.Parallel()
+	e := testExif(binary.LittleEndian)
+	zero := make([]byte, 8)
+	e.order.PutUint32(zero[4:], 1)
+	e.exif = append(e.exif, ifdEntry{tag: tagExposureTime, typ: 5, count: 1, value: zero})
+
+	parsed, err := parseExif(e.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.summary().ExposureTime; got != "" {
+		t.Errorf("summary() exposure time = %q, want none for 0/1", got)
+	}
+}
+
+func Test_colorModelOf(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		m     color.Model
+		model string
+		depth int
+	}{
+		{"ycbcr", color.YCbCrModel, "ycbcr", 8},
+		{"nrgba", color.NRGBAModel, "rgb", 8},
+		{"rgba64", color.RGBA64Model, "rgb", 16},
+		{"gray16", color.Gray16Model, "gray", 16},
+		{"cmyk", color.CMYKModel, "cmyk", 8},
+		{"palette", color.Palette{color.Black}, "paletted", 8},
+	}
+	for _, tt := range tests {
+		model, depth := colorModelOf(tt.m)
+		if model != tt.model || depth != tt.depth {
+			t.Errorf("colorModelOf(%s) = %s, %d, want %s, %d", tt.name, model, depth, tt.model, tt.depth)
+		}
+	}
+}
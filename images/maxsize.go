@@ -0,0 +1,130 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/johan-st/go-image-server/units/size"
+)
+
+const (
+	// maxBudgetSteps limits how many times an image is scaled down while
+	// trying to fit within ImageParameters.MaxSize.
+	maxBudgetSteps = 8
+
+	// minBudgetDimension is the smallest width or height (in pixels) we are
+	// willing to scale down to in order to meet a MaxSize budget.
+	minBudgetDimension = 16
+)
+
+// encodeFunc encodes an image at the given quality and scale. A scale of 1
+// means the requested output dimensions.
+type encodeFunc func(w io.Writer, quality int, scale float64) error
+
+// fitBudget encodes an image within the given budget. The encoder is first
+// called with the highest quality at full scale. If the result does not fit,
+// the highest quality in [qMin, qMax] that fits is searched for. If no
+// quality fits, the image is scaled down and the search is repeated.
+//
+// dims are the dimensions of the output at full scale. A budget of 0 means no
+// limit. ErrMaxSize is returned if the budget could not be met.
+func fitBudget(budget size.S, dims image.Point, qMin, qMax int, enc encodeFunc) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := enc(buf, qMax, 1)
+	if err != nil {
+		return nil, err
+	}
+	if budget == 0 || size.S(buf.Len()) <= budget {
+		return buf.Bytes(), nil
+	}
+
+	scale := 1.0
+	smallest := size.S(buf.Len())
+	for step := 0; step < maxBudgetSteps; step++ {
+		fit, small, err := searchQuality(budget, qMin, qMax, scale, enc)
+		if err != nil {
+			return nil, err
+		}
+		if fit != nil {
+			return fit, nil
+		}
+		smallest = small
+
+		// Encoded size is roughly proportional to the number of pixels.
+		// Aim a bit below the budget to avoid too many steps.
+		factor := math.Sqrt(float64(budget)/float64(small)) * 0.9
+		factor = math.Max(0.1, math.Min(factor, 0.9))
+		scale *= factor
+
+		w := float64(dims.X) * scale
+		h := float64(dims.Y) * scale
+		if (dims.X != 0 && w < minBudgetDimension) || (dims.Y != 0 && h < minBudgetDimension) {
+			break
+		}
+	}
+	return nil, ErrMaxSize{MaxSize: budget, Smallest: smallest}
+}
+
+// searchQuality does a binary search for the highest quality in [qMin, qMax]
+// that fits within budget at the given scale. If no quality fits, fit is nil
+// and small is the size of the result at qMin.
+func searchQuality(budget size.S, qMin, qMax int, scale float64, enc encodeFunc) (fit []byte, small size.S, err error) {
+	lo, hi := qMin, qMax
+	for lo <= hi {
+		q := (lo + hi) / 2
+		buf := &bytes.Buffer{}
+		err = enc(buf, q, scale)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size.S(buf.Len()) <= budget {
+			fit = buf.Bytes()
+			lo = q + 1
+			continue
+		}
+		if q == qMin {
+			small = size.S(buf.Len())
+		}
+		hi = q - 1
+	}
+	return fit, small, nil
+}
+
+// qualityRange returns the range of qualities that can be searched when
+// trying to fit an image within a MaxSize budget.
+func qualityRange(params ImageParameters) (qMin int, qMax int) {
+	switch {
+	case params.Format == Jpeg:
+		qMin = 1
+	case params.Format == Gif, params.Format == Png8:
+		qMin = 2
+	case params.Format == Webp && !params.Lossless:
+		qMin = 1
+	default:
+		// quality does not affect the size of the output
+		qMin = params.Quality
+	}
+	if qMin > params.Quality {
+		qMin = params.Quality
+	}
+	return qMin, params.Quality
+}
+
+// ErrMaxSize is returned when an image could not be encoded within the
+// requested MaxSize.
+type ErrMaxSize struct {
+	MaxSize  size.S
+	Smallest size.S
+}
+
+func (e ErrMaxSize) Error() string {
+	return fmt.Sprintf("could not fit image within max size %s (smallest attempt was %s)", e.MaxSize, e.Smallest)
+}
+
+func (e ErrMaxSize) Is(err error) bool {
+	_, ok := err.(ErrMaxSize)
+	return ok
+}
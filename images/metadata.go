@@ -0,0 +1,482 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/chai2010/webp"
+)
+
+// Metadata is the policy for which exif metadata of the original is kept in
+// generated images.
+type Metadata string
+
+const (
+	MetadataStrip     Metadata = "strip"     // no metadata
+	MetadataCopyright Metadata = "copyright" // artist and copyright only
+	MetadataNoGps     Metadata = "nogps"     // everything except location
+)
+
+func (m Metadata) String() string {
+	return string(m)
+}
+
+func ParseMetadata(s string) (Metadata, error) {
+	switch s {
+	case "strip":
+		return MetadataStrip, nil
+	case "copyright":
+		return MetadataCopyright, nil
+	case "nogps":
+		return MetadataNoGps, nil
+	}
+	return "", fmt.Errorf("invalid metadata policy. \n\tGot: '%s'\n\tWant: 'strip', 'copyright', 'nogps'", s)
+}
+
+// Tags that are not carried over when exif data is rewritten. Their values
+// either point into the original file or hold data that can not be checked
+// for location information.
+var (
+	offsetTags = []uint16{
+		0x0111, // StripOffsets
+		0x0117, // StripByteCounts
+		0x0144, // TileOffsets
+		0x0145, // TileByteCounts
+		0x0201, // JPEGInterchangeFormat
+		0x0202, // JPEGInterchangeFormatLength
+		0x02bc, // XMP
+		tagSubIFDs,
+	}
+	opaqueExifTags = []uint16{tagMakerNote, tagInteropIFD}
+
+	// tags describing the pixel data of the original
+	dimensionTags     = []uint16{0x0100, 0x0101, tagOrientation} // ImageWidth, ImageLength
+	exifDimensionTags = []uint16{tagPixelXDimension, tagPixelYDimension}
+)
+
+// withoutGps returns a copy of e without location data.
+func (e *exifData) withoutGps() *exifData {
+	return &exifData{
+		order: e.order,
+		ifd0:  without(e.ifd0, offsetTags...),
+		exif:  without(e.exif, opaqueExifTags...),
+	}
+}
+
+// forVariant returns the exif data to keep in a generated image according to
+// policy. nil is returned if nothing should be kept.
+func (e *exifData) forVariant(policy Metadata) *exifData {
+	var v *exifData
+	switch policy {
+	case MetadataCopyright:
+		v = &exifData{order: e.order, ifd0: only(e.ifd0, tagArtist, tagCopyright)}
+	case MetadataNoGps:
+		// generated images are upright and resized
+		v = e.withoutGps()
+		v.ifd0 = without(v.ifd0, dimensionTags...)
+		v.exif = without(v.exif, exifDimensionTags...)
+	default:
+		return nil
+	}
+	if len(v.ifd0) == 0 && len(v.exif) == 0 {
+		return nil
+	}
+	return v
+}
+
+// without returns the entries not matching any of the given tags.
+func without(entries []ifdEntry, tags ...uint16) []ifdEntry {
+	res := []ifdEntry{}
+	for _, e := range entries {
+		if !containsTag(tags, e.tag) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// only returns the entries matching any of the given tags.
+func only(entries []ifdEntry, tags ...uint16) []ifdEntry {
+	res := []ifdEntry{}
+	for _, e := range entries {
+		if containsTag(tags, e.tag) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func containsTag(tags []uint16, tag uint16) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// bytes encodes e as a TIFF structure. IFD0 is followed by the exif and GPS
+// directories, if any.
+func (e *exifData) bytes() []byte {
+	ifd0 := append([]ifdEntry{}, e.ifd0...)
+	exifPtr := ifdEntry{tag: tagExifIFD, typ: 4, count: 1, value: make([]byte, 4)}
+	gpsPtr := ifdEntry{tag: tagGpsIFD, typ: 4, count: 1, value: make([]byte, 4)}
+	if len(e.exif) > 0 {
+		ifd0 = append(ifd0, exifPtr)
+	}
+	if len(e.gps) > 0 {
+		ifd0 = append(ifd0, gpsPtr)
+	}
+
+	// the pointers are part of ifd0 so its size is known before they are set
+	exifOffset := 8 + ifdSize(ifd0)
+	gpsOffset := exifOffset + ifdSize(e.exif)
+	e.order.PutUint32(exifPtr.value, exifOffset)
+	e.order.PutUint32(gpsPtr.value, gpsOffset)
+
+	buf := &bytes.Buffer{}
+	if e.order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(buf, e.order, uint32(8))
+	writeIfd(buf, e.order, ifd0, 8)
+	if len(e.exif) > 0 {
+		writeIfd(buf, e.order, e.exif, exifOffset)
+	}
+	if len(e.gps) > 0 {
+		writeIfd(buf, e.order, e.gps, gpsOffset)
+	}
+	return buf.Bytes()
+}
+
+// ifdSize returns the encoded size of a directory including its values.
+func ifdSize(entries []ifdEntry) uint32 {
+	if len(entries) == 0 {
+		return 0
+	}
+	size := uint32(2 + 12*len(entries) + 4)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += uint32(len(e.value) + len(e.value)%2)
+		}
+	}
+	return size
+}
+
+// writeIfd writes a directory at offset, followed by the values that do not
+// fit in its entries. Entries are sorted by tag as required by TIFF.
+func writeIfd(buf *bytes.Buffer, order binary.ByteOrder, entries []ifdEntry, offset uint32) {
+	sorted := append([]ifdEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].tag < sorted[j].tag })
+
+	dataOffset := offset + 2 + 12*uint32(len(sorted)) + 4
+	data := &bytes.Buffer{}
+	raw := make([]byte, 12)
+
+	binary.Write(buf, order, uint16(len(sorted)))
+	for _, e := range sorted {
+		order.PutUint16(raw[0:], e.tag)
+		order.PutUint16(raw[2:], e.typ)
+		order.PutUint32(raw[4:], e.count)
+		if len(e.value) <= 4 {
+			copy(raw[8:], []byte{0, 0, 0, 0})
+			copy(raw[8:], e.value)
+		} else {
+			order.PutUint32(raw[8:], dataOffset+uint32(data.Len()))
+			data.Write(e.value)
+			if len(e.value)%2 == 1 {
+				data.WriteByte(0)
+			}
+		}
+		buf.Write(raw)
+	}
+	// no next directory
+	binary.Write(buf, order, uint32(0))
+	buf.Write(data.Bytes())
+}
+
+// variantExif returns the exif data from the original at path to embed in
+// generated images according to policy. nil is returned if there is none.
+func variantExif(path string, policy Metadata) ([]byte, error) {
+	if policy == "" || policy == MetadataStrip {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw, err := readExif(file)
+	if err != nil {
+		return nil, nil
+	}
+	e, err := parseExif(raw)
+	if err != nil {
+		return nil, err
+	}
+	v := e.forVariant(policy)
+	if v == nil {
+		return nil, nil
+	}
+	return v.bytes(), nil
+}
+
+// embedExif returns the encoded image data with the given exif data added.
+// Gif has no way to carry exif data and is returned unchanged.
+func embedExif(data []byte, format Format, tiff []byte) ([]byte, error) {
+	switch format {
+	case Jpeg:
+		return embedExifJpeg(data, tiff)
+	case Png, Png8:
+		return embedExifPng(data, tiff)
+	case Webp:
+		return webp.SetMetadata(data, tiff, "EXIF")
+	}
+	return data, nil
+}
+
+var (
+	jpegExifPrefix = []byte("Exif\x00\x00")
+	jpegXmpPrefix  = []byte("http://ns.adobe.com/")
+)
+
+// embedExifJpeg inserts an APP1 segment after SOI and any APP0 (JFIF) segment.
+func embedExifJpeg(data []byte, tiff []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("invalid jpeg data")
+	}
+	seg := append(append([]byte{}, jpegExifPrefix...), tiff...)
+	if len(seg)+2 > 0xffff {
+		return nil, fmt.Errorf("exif data too large for jpeg: %d bytes", len(seg))
+	}
+
+	pos := 2
+	if data[2] == 0xff && data[3] == 0xe0 && len(data) >= 6 {
+		pos += 2 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	if pos > len(data) {
+		return nil, fmt.Errorf("invalid jpeg data")
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(data[:pos])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(out, binary.BigEndian, uint16(len(seg)+2))
+	out.Write(seg)
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+// embedExifPng inserts an eXIf chunk before the first IDAT chunk.
+func embedExifPng(data []byte, tiff []byte) ([]byte, error) {
+	pos := 8
+	for {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("invalid png data")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if string(data[pos+4:pos+8]) == "IDAT" {
+			break
+		}
+		pos += 12 + length
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(data[:pos])
+	writePngChunk(out, "eXIf", tiff)
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+func writePngChunk(w io.Writer, typ string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	w.Write([]byte(typ))
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// scrubGps returns the image read from r with location data removed from
+// its exif data. XMP metadata, which may hold location data as well, is
+// dropped. The pixel data is not touched.
+func scrubGps(r io.Reader, format Format) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case Jpeg:
+		data, err = scrubGpsJpeg(data)
+	case Png:
+		data, err = scrubGpsPng(data)
+	case Webp:
+		data, err = scrubGpsWebp(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// scrubExif returns the exif data without location data, or nil if the
+// data can not be parsed.
+func scrubExif(tiff []byte) []byte {
+	e, err := parseExif(tiff)
+	if err != nil {
+		return nil
+	}
+	return e.withoutGps().bytes()
+}
+
+func scrubGpsJpeg(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("invalid jpeg data")
+	}
+	out := &bytes.Buffer{}
+	out.Write(data[:2])
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, fmt.Errorf("invalid jpeg data")
+		}
+		marker := data[pos+1]
+		// start of scan, the rest is image data
+		if marker == 0xda {
+			break
+		}
+		start := pos
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			return nil, fmt.Errorf("invalid jpeg segment length")
+		}
+		seg := data[pos+4 : end]
+		pos = end
+
+		switch {
+		case marker != 0xe1:
+			out.Write(data[start:end])
+		case bytes.HasPrefix(seg, jpegXmpPrefix):
+			// xmp
+		case bytes.HasPrefix(seg, jpegExifPrefix):
+			if scrubbed := scrubExif(seg[len(jpegExifPrefix):]); scrubbed != nil {
+				app1 := append(append([]byte{}, jpegExifPrefix...), scrubbed...)
+				out.Write([]byte{0xff, 0xe1})
+				binary.Write(out, binary.BigEndian, uint16(len(app1)+2))
+				out.Write(app1)
+			}
+		default:
+			out.Write(data[start:end])
+		}
+	}
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+func scrubGpsPng(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("invalid png data")
+	}
+	out := &bytes.Buffer{}
+	out.Write(data[:8])
+	pos := 8
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("invalid png data")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if end > len(data) {
+			return nil, fmt.Errorf("invalid png chunk length")
+		}
+		typ := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+length]
+
+		switch {
+		case typ == "eXIf":
+			if scrubbed := scrubExif(chunk); scrubbed != nil {
+				writePngChunk(out, "eXIf", scrubbed)
+			}
+		case typ == "iTXt" && bytes.HasPrefix(chunk, []byte("XML:com.adobe.xmp\x00")):
+			// xmp
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+// webp VP8X header flags
+const (
+	webpFlagXmp  = 0x04
+	webpFlagExif = 0x08
+)
+
+func scrubGpsWebp(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("invalid webp data")
+	}
+	chunks := &bytes.Buffer{}
+	flagsAt := -1 // position of the VP8X flags in chunks
+	clearFlags := byte(0)
+	pos := 12
+	for pos+8 <= len(data) {
+		typ := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length + length%2
+		if pos+8+length > len(data) {
+			return nil, fmt.Errorf("invalid webp chunk length")
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[pos+8 : pos+8+length]
+
+		switch typ {
+		case "EXIF":
+			tiff, _ := bytes.CutPrefix(chunk, jpegExifPrefix)
+			if scrubbed := scrubExif(tiff); scrubbed != nil {
+				writeWebpChunk(chunks, "EXIF", scrubbed)
+			} else {
+				clearFlags |= webpFlagExif
+			}
+		case "XMP ":
+			clearFlags |= webpFlagXmp
+		default:
+			if typ == "VP8X" && length > 0 {
+				flagsAt = chunks.Len() + 8
+			}
+			writeWebpChunk(chunks, typ, chunk)
+		}
+		pos = end
+	}
+	if flagsAt >= 0 {
+		chunks.Bytes()[flagsAt] &^= clearFlags
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString("RIFF")
+	binary.Write(out, binary.LittleEndian, uint32(4+chunks.Len()))
+	out.WriteString("WEBP")
+	out.Write(chunks.Bytes())
+	return out.Bytes(), nil
+}
+
+func writeWebpChunk(w *bytes.Buffer, typ string, data []byte) {
+	w.WriteString(typ)
+	binary.Write(w, binary.LittleEndian, uint32(len(data)))
+	w.Write(data)
+	if len(data)%2 == 1 {
+		w.WriteByte(0)
+	}
+}
@@ -0,0 +1,198 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/chai2010/webp"
+)
+
+func Test_exifData_bytes(t *testing.T) {
+	t.Parallel()
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		e := testExif(order)
+		got, err := parseExif(e.bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.ifd0) != len(e.ifd0) || len(got.exif) != len(e.exif) || len(got.gps) != len(e.gps) {
+			t.Fatalf("%s: parseExif(bytes()) = %d/%d/%d entries, want %d/%d/%d", order,
+				len(got.ifd0), len(got.exif), len(got.gps), len(e.ifd0), len(e.exif), len(e.gps))
+		}
+		artist, _ := find(got.ifd0, tagArtist)
+		if string(artist.value) != "Jane Doe\x00" {
+			t.Errorf("%s: artist = %q", order, artist.value)
+		}
+		if o := got.orientation(); o != orientRotate90 {
+			t.Errorf("%s: orientation = %d, want %d", order, o, orientRotate90)
+		}
+	}
+}
+
+func Test_exifData_forVariant(t *testing.T) {
+	t.Parallel()
+	e := testExif(binary.LittleEndian)
+
+	if v := e.forVariant(MetadataStrip); v != nil {
+		t.Errorf("forVariant(strip) = %+v, want nil", v)
+	}
+
+	v := e.forVariant(MetadataCopyright)
+	if len(v.ifd0) != 2 || len(v.exif) != 0 || len(v.gps) != 0 {
+		t.Errorf("forVariant(copyright) kept %+v", v)
+	}
+
+	v = e.forVariant(MetadataNoGps)
+	if len(v.gps) != 0 {
+		t.Errorf("forVariant(nogps) kept gps data")
+	}
+	if _, ok := find(v.exif, tagMakerNote); ok {
+		t.Errorf("forVariant(nogps) kept maker note")
+	}
+	if _, ok := find(v.ifd0, tagOrientation); ok {
+		t.Errorf("forVariant(nogps) kept orientation")
+	}
+	if _, ok := find(v.exif, tagDateTimeOriginal); !ok {
+		t.Errorf("forVariant(nogps) dropped DateTimeOriginal")
+	}
+}
+
+func Test_embedExif(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	tiff := testExif(binary.BigEndian).forVariant(MetadataCopyright).bytes()
+
+	for _, format := range []Format{Jpeg, Png, Webp} {
+		buf := &bytes.Buffer{}
+		err := encodeImageWithExif(buf, img, ImageParameters{Format: format, Quality: 80}, tiff)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		got, err := readExif(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: readExif() error = %s", format, err)
+		}
+		if !bytes.Equal(got, tiff) {
+			t.Errorf("%s: embedded exif does not match", format)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("%s: image with exif can not be decoded: %s", format, err)
+		}
+	}
+}
+
+func Test_scrubGps(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	tiff := testExif(binary.LittleEndian).bytes()
+
+	encoded := map[Format][]byte{}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := embedExifJpeg(buf.Bytes(), tiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add an xmp packet after the exif segment
+	xmp := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), "<x:xmpmeta/>"...)
+	app1 := append([]byte{0xff, 0xe1, byte((len(xmp) + 2) >> 8), byte(len(xmp) + 2)}, xmp...)
+	pos := 4 + int(binary.BigEndian.Uint16(data[4:])) // SOI and exif segment
+	encoded[Jpeg] = append(append(append([]byte{}, data[:pos]...), app1...), data[pos:]...)
+
+	buf.Reset()
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if encoded[Png], err = embedExifPng(buf.Bytes(), tiff); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	if err := webp.Encode(buf, img, &webp.Options{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if encoded[Webp], err = webp.SetMetadata(buf.Bytes(), tiff, "EXIF"); err != nil {
+		t.Fatal(err)
+	}
+
+	for format, data := range encoded {
+		r, err := scrubGps(bytes.NewReader(data), format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		scrubbed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(scrubbed, []byte("xmpmeta")) {
+			t.Errorf("%s: scrubGps() kept xmp", format)
+		}
+		raw, err := readExif(bytes.NewReader(scrubbed))
+		if err != nil {
+			t.Fatalf("%s: readExif() error = %s", format, err)
+		}
+		e, err := parseExif(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.gps) != 0 {
+			t.Errorf("%s: scrubGps() kept gps data", format)
+		}
+		if e.orientation() != orientRotate90 {
+			t.Errorf("%s: scrubGps() orientation = %d, want %d", format, e.orientation(), orientRotate90)
+		}
+		if _, ok := find(e.ifd0, tagCopyright); !ok {
+			t.Errorf("%s: scrubGps() dropped copyright", format)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(scrubbed)); err != nil {
+			t.Errorf("%s: scrubbed image can not be decoded: %s", format, err)
+		}
+	}
+}
+
+// testExif returns exif data with author, orientation, exif and gps tags.
+func testExif(order binary.ByteOrder) *exifData {
+	short := func(v uint16) []byte {
+		b := make([]byte, 2)
+		order.PutUint16(b, v)
+		return b
+	}
+	rationals := func(vs ...uint32) []byte {
+		b := make([]byte, 4*len(vs))
+		for i, v := range vs {
+			order.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	ascii := func(s string) ifdEntry {
+		return ifdEntry{typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+	}
+
+	artist, copyright, date := ascii("Jane Doe"), ascii("(c) Jane Doe"), ascii("2023:06:01 12:00:00")
+	artist.tag, copyright.tag, date.tag = tagArtist, tagCopyright, tagDateTimeOriginal
+
+	return &exifData{
+		order: order,
+		ifd0: []ifdEntry{
+			{tag: tagOrientation, typ: 3, count: 1, value: short(orientRotate90)},
+			artist,
+			copyright,
+		},
+		exif: []ifdEntry{
+			date,
+			{tag: tagMakerNote, typ: 7, count: 6, value: []byte("secret")},
+			{tag: tagPixelXDimension, typ: 3, count: 1, value: short(4000)},
+		},
+		gps: []ifdEntry{
+			{tag: 0x0001, typ: 2, count: 2, value: []byte("N\x00")},               // GPSLatitudeRef
+			{tag: 0x0002, typ: 5, count: 3, value: rationals(59, 1, 20, 1, 0, 1)}, // GPSLatitude
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// loadOriginals indexes the originals directory. Each original is expected
+// to be named "<id>.<format>". Files whose name does not match the format
+// they are encoded in (e.g. a png named "1.jpeg", as stored by earlier
+// versions) are renamed, unless a file of the new name exists. Files that
+// are not originals are ignored.
+func (h *ImageHandler) loadOriginals() error {
+	l := h.opts.l
+
+	entries, err := os.ReadDir(h.opts.dirOriginals)
+	if err != nil {
+		return err
+	}
+
+	originals := make(map[int]Format, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if strings.HasSuffix(name, sidecarExt) {
+			continue
+		}
+		idStr, _, _ := strings.Cut(name, ".")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id < 1 {
+			l.Debug("loadOriginals: ignoring file", "file", name)
+			continue
+		}
+
+		path := filepath.Join(h.opts.dirOriginals, name)
+		format, err := detectFormat(path)
+		if err != nil {
+			l.Warn("loadOriginals: ignoring file that could not be read as an image", "file", name, "error", err)
+			continue
+		}
+		if f, ok := originals[id]; ok {
+			l.Warn("loadOriginals: ignoring duplicate original", "id", id, "file", name, "using", f)
+			continue
+		}
+
+		want := originalName(id, format)
+		if name != want {
+			wantPath := filepath.Join(h.opts.dirOriginals, want)
+			// never overwrite an original, e.g. "1.png" next to a png named
+			// "1.jpeg"
+			if _, err := os.Stat(wantPath); !errors.Is(err, os.ErrNotExist) {
+				l.Warn("loadOriginals: ignoring file that can not be migrated", "file", name, "to", want, "error", err)
+				continue
+			}
+			err = os.Rename(path, wantPath)
+			if err != nil {
+				return fmt.Errorf("could not migrate original '%s' to '%s': %w", name, want, err)
+			}
+			l.Info("migrated original", "from", name, "to", want)
+		}
+		originals[id] = format
+	}
+
+	h.mu.Lock()
+	h.originals = originals
+	h.mu.Unlock()
+	return nil
+}
+
+// detectFormat returns the format of the image file at path.
+func detectFormat(path string) (Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, name, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", err
+	}
+	return ParseFormat(name)
+}
+
+// originalName returns the file name of an original.
+func originalName(id int, f Format) string {
+	return strconv.Itoa(id) + "." + f.String()
+}
+
+// originalPath returns the path to the original with the given id.
+func (h *ImageHandler) originalPath(id int) (string, error) {
+	path, _, err := h.original(id)
+	return path, err
+}
+
+// original returns the path to and format of the original with the given id.
+func (h *ImageHandler) original(id int) (string, Format, error) {
+	h.mu.Lock()
+	f, ok := h.originals[id]
+	h.mu.Unlock()
+	if !ok {
+		return "", "", ErrIdNotFound{IdGiven: id, Err: os.ErrNotExist}
+	}
+	return filepath.Join(h.opts.dirOriginals, originalName(id, f)), f, nil
+}
+
+// loadOriginal returns the decoded original with the given id, upright. Gifs
+// give their first frame.
+func (h *ImageHandler) loadOriginal(id int) (image.Image, error) {
+	path, format, err := h.original(id)
+	if err != nil {
+		return nil, err
+	}
+	if format == Gif {
+		anim, err := loadGif(path)
+		if err != nil {
+			return nil, err
+		}
+		return gifFrame(anim, 1), nil
+	}
+	return loadImage(path)
+}
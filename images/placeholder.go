@@ -0,0 +1,199 @@
+package images
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// width and height of the image a BlurHash is computed from
+	blurHashSampleSize = 32
+	// longest side of the preview in a placeholder data uri
+	previewSize = 16
+)
+
+// Placeholder is shown while an image loads.
+type Placeholder struct {
+	// BlurHash of the image (https://blurha.sh)
+	BlurHash string `json:"blurhash"`
+	// tiny preview as a base64 data uri, to be scaled up and blurred by the
+	// client
+	DataUri string `json:"dataUri"`
+}
+
+// Placeholder returns the placeholder of the image with the given id. It is
+// computed once and stored with the original.
+func (h *ImageHandler) Placeholder(id int) (Placeholder, error) {
+	_, err := h.originalPath(id)
+	if err != nil {
+		return Placeholder{}, err
+	}
+	sc, err := h.readSidecar(id)
+	if err != nil {
+		return Placeholder{}, err
+	}
+	if sc.Placeholder != nil {
+		return *sc.Placeholder, nil
+	}
+
+	img, err := h.loadOriginal(id)
+	if err != nil {
+		return Placeholder{}, err
+	}
+	p, err := newPlaceholder(img)
+	if err != nil {
+		return Placeholder{}, err
+	}
+	err = h.updateSidecar(id, func(sc *sidecar) {
+		sc.Placeholder = &p
+	})
+	if err != nil {
+		return Placeholder{}, fmt.Errorf("could not store placeholder: %w", err)
+	}
+	return p, nil
+}
+
+// newPlaceholder computes the placeholder of img.
+func newPlaceholder(img image.Image) (Placeholder, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return Placeholder{}, fmt.Errorf("can not create a placeholder for an empty image")
+	}
+
+	// 4 components along the longer side, 3 along the shorter
+	xComp, yComp := 4, 3
+	if b.Dy() > b.Dx() {
+		xComp, yComp = 3, 4
+	}
+	sample := resize.Resize(blurHashSampleSize, blurHashSampleSize, img, resize.Bilinear)
+	hash := blurHash(sample, xComp, yComp)
+
+	w, h := uint(previewSize), uint(0)
+	if b.Dy() > b.Dx() {
+		w, h = 0, previewSize
+	}
+	preview := resize.Resize(w, h, img, resize.Bilinear)
+	buf := &bytes.Buffer{}
+	mediaType := "image/jpeg"
+	var err error
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		mediaType = "image/png"
+		err = png.Encode(buf, preview)
+	} else {
+		err = jpeg.Encode(buf, preview, &jpeg.Options{Quality: 60})
+	}
+	if err != nil {
+		return Placeholder{}, err
+	}
+
+	return Placeholder{
+		BlurHash: hash,
+		DataUri:  "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// blurHash encodes img as a BlurHash with the given number of components
+// (1-9) along each axis.
+func blurHash(img image.Image, xComp, yComp int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// linear colors of the image
+	pix := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			pix[y*w+x] = [3]float64{srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(bl >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					for c := 0; c < 3; c++ {
+						f[c] += basis * pix[y*w+x][c]
+					}
+				}
+			}
+			for c := 0; c < 3; c++ {
+				f[c] *= norm / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	hash := strings.Builder{}
+	hash.WriteString(base83((xComp-1)+(yComp-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(base83(quantisedMax, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+
+	hash.WriteString(base83(linearToSrgb(dc[0])<<16|linearToSrgb(dc[1])<<8|linearToSrgb(dc[2]), 4))
+	for _, f := range ac {
+		quant := func(v float64) int {
+			signPow := math.Copysign(math.Sqrt(math.Abs(v/maxValue)), v)
+			return int(math.Max(0, math.Min(18, math.Floor(signPow*9+9.5))))
+		}
+		hash.WriteString(base83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// base83 encodes v as length characters.
+func base83(v, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[v%83]
+		v /= 83
+	}
+	return string(out)
+}
+
+// srgbToLinear converts an 8 bit sRGB channel to linear light, 0 to 1.
+func srgbToLinear(v uint32) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// linearToSrgb converts linear light to an 8 bit sRGB channel.
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
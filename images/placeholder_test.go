@@ -0,0 +1,104 @@
+package images
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+func Test_blurHash(t *testing.T) {
+	t.Parallel()
+	red := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(red, red.Rect, image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+
+	// the size flag, maximum and average color come first
+	got := blurHash(red, 4, 3)
+	if len(got) != 6+2*11 || got[0] != 'L' || got[2:6] != "TI:j" {
+		t.Errorf("blurHash() = %s, want 28 characters starting with L?TI:j", got)
+	}
+	if got := blurHash(red, 1, 1); got != "00TI:j" {
+		t.Errorf("blurHash() with one component = %s, want 00TI:j", got)
+	}
+
+	// black left and white right, or top and bottom
+	leftRight := image.NewGray(image.Rect(0, 0, 8, 8))
+	topBottom := image.NewGray(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if x >= 4 {
+				leftRight.SetGray(x, y, color.Gray{255})
+			}
+			if y >= 4 {
+				topBottom.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	lr, tb := blurHash(leftRight, 4, 3), blurHash(topBottom, 4, 3)
+	if lr[2:6] != tb[2:6] {
+		t.Errorf("blurHash() average colors %s and %s differ", lr[2:6], tb[2:6])
+	}
+	if lr == tb {
+		t.Errorf("blurHash() = %s for both halves", lr)
+	}
+}
+
+func Test_base83(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		v, length int
+		want      string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		{0xff0000, 4, "TI:j"},
+	}
+	for _, tt := range tests {
+		if got := base83(tt.v, tt.length); got != tt.want {
+			t.Errorf("base83(%d, %d) = %s, want %s", tt.v, tt.length, got, tt.want)
+		}
+	}
+}
+
+func Test_newPlaceholder(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		img       image.Image
+		mediaType string
+		size      image.Point
+	}{
+		{"landscape", image.NewYCbCr(image.Rect(0, 0, 400, 200), image.YCbCrSubsampleRatio420), "image/jpeg", image.Pt(16, 8)},
+		{"portrait", image.NewYCbCr(image.Rect(0, 0, 100, 300), image.YCbCrSubsampleRatio420), "image/jpeg", image.Pt(6, 16)},
+		{"transparent", image.NewNRGBA(image.Rect(0, 0, 64, 64)), "image/png", image.Pt(16, 16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPlaceholder(tt.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.BlurHash) != 28 {
+				t.Errorf("newPlaceholder() blurhash = %s, want 28 characters", p.BlurHash)
+			}
+			prefix := "data:" + tt.mediaType + ";base64,"
+			if !strings.HasPrefix(p.DataUri, prefix) {
+				t.Fatalf("newPlaceholder() data uri = %.40s, want prefix %s", p.DataUri, prefix)
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p.DataUri, prefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf, _, err := image.DecodeConfig(strings.NewReader(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := image.Pt(conf.Width, conf.Height); got != tt.size {
+				t.Errorf("newPlaceholder() preview size = %v, want %v", got, tt.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// Dither is how colors missing from a palette are approximated.
+type Dither string
+
+const (
+	DitherNone           Dither = "none"    // nearest color, flat areas
+	DitherFloydSteinberg Dither = "fs"      // error diffusion
+	DitherOrdered        Dither = "ordered" // bayer pattern, compresses better
+)
+
+func (d Dither) String() string {
+	return string(d)
+}
+
+func ParseDither(s string) (Dither, error) {
+	switch s {
+	case "none":
+		return DitherNone, nil
+	case "fs":
+		return DitherFloydSteinberg, nil
+	case "ordered":
+		return DitherOrdered, nil
+	}
+	return "", fmt.Errorf("invalid dither. \n\tGot: '%s'\n\tWant: 'none', 'fs', 'ordered'", s)
+}
+
+// quantize returns img reduced to a palette of at most numColors colors
+// (2-256), alpha included. The palette is built by median cut over the
+// colors of the image. The zero value of dither is Floyd-Steinberg.
+func quantize(img image.Image, numColors int, dither Dither) *image.Paletted {
+	b := img.Bounds()
+	palette := medianCut(colorHistogram(img), clampColors(numColors))
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	ditherTo(dst, img, dither)
+	return dst
+}
+
+// ditherTo draws img onto dst, approximating colors missing from the
+// palette of dst as given by dither. The zero value of dither is
+// Floyd-Steinberg.
+func ditherTo(dst *image.Paletted, img image.Image, dither Dither) {
+	switch dither {
+	case DitherNone:
+		mapColors(dst, img, nil)
+	case DitherOrdered:
+		spread := 255 / math.Cbrt(float64(len(dst.Palette)))
+		mapColors(dst, img, func(x, y int, c color.NRGBA) color.NRGBA {
+			offset := (bayer8[y%8][x%8] - 31.5) / 64 * spread
+			return color.NRGBA{
+				R: clampUint8(float64(c.R) + offset),
+				G: clampUint8(float64(c.G) + offset),
+				B: clampUint8(float64(c.B) + offset),
+				A: c.A,
+			}
+		})
+	default:
+		draw.FloydSteinberg.Draw(dst, dst.Rect, img, img.Bounds().Min)
+	}
+}
+
+// bayer8 is the threshold map of ordered dithering.
+var bayer8 = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// mapColors sets every pixel of dst to the palette color closest to the
+// pixel of img, after adjust if not nil.
+func mapColors(dst *image.Paletted, img image.Image, adjust func(x, y int, c color.NRGBA) color.NRGBA) {
+	b := img.Bounds()
+	// images rarely have many distinct colors, so lookups are kept
+	mapped := map[color.NRGBA]uint8{}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if adjust != nil {
+				c = adjust(x, y, c)
+			}
+			c = opaqueOrClear(c)
+			i, ok := mapped[c]
+			if !ok {
+				i = uint8(nearestColor(dst.Palette, c))
+				mapped[c] = i
+			}
+			dst.Pix[y*dst.Stride+x] = i
+		}
+	}
+}
+
+// binaryAlpha returns img with every pixel either opaque or fully
+// transparent, as gif can not show anything in between.
+func binaryAlpha(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	for i := 3; i < len(dst.Pix); i += 4 {
+		if dst.Pix[i] < 128 {
+			dst.Pix[i] = 0
+		} else {
+			dst.Pix[i] = 255
+		}
+	}
+	return dst
+}
+
+// clampColors returns n within the number of colors a palette can have.
+func clampColors(n int) int {
+	if n < 2 {
+		return 2
+	}
+	if n > 256 {
+		return 256
+	}
+	return n
+}
+
+// opaqueOrClear returns c with all fully transparent colors made the same.
+func opaqueOrClear(c color.NRGBA) color.NRGBA {
+	if c.A == 0 {
+		return color.NRGBA{}
+	}
+	return c
+}
+
+// histogramBin is a color of the histogram. Colors are grouped by their 5
+// most significant bits per channel and averaged.
+type histogramBin struct {
+	// premultiplied sums of all pixels in the bin
+	r, g, b, a uint64
+	count      uint64
+	// average color, premultiplied
+	mean [4]uint8
+}
+
+// colorHistogram returns the colors of img grouped into bins.
+func colorHistogram(img image.Image) []*histogramBin {
+	bins := map[uint32]*histogramBin{}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			r, g, bl, a = r>>8, g>>8, bl>>8, a>>8
+			key := r>>3<<15 | g>>3<<10 | bl>>3<<5 | a>>3
+			bin, ok := bins[key]
+			if !ok {
+				bin = &histogramBin{}
+				bins[key] = bin
+			}
+			bin.r += uint64(r)
+			bin.g += uint64(g)
+			bin.b += uint64(bl)
+			bin.a += uint64(a)
+			bin.count++
+		}
+	}
+
+	hist := make([]*histogramBin, 0, len(bins))
+	for _, bin := range bins {
+		bin.mean = [4]uint8{
+			uint8(bin.r / bin.count),
+			uint8(bin.g / bin.count),
+			uint8(bin.b / bin.count),
+			uint8(bin.a / bin.count),
+		}
+		hist = append(hist, bin)
+	}
+	return hist
+}
+
+// colorBox is a group of histogram bins that becomes one palette color.
+type colorBox struct {
+	bins  []*histogramBin
+	count uint64
+	// channel with the largest range within the box and the size of that
+	// range
+	channel, width int
+}
+
+// newColorBox returns a box holding bins.
+func newColorBox(bins []*histogramBin) colorBox {
+	box := colorBox{bins: bins}
+	lo := [4]uint8{255, 255, 255, 255}
+	hi := [4]uint8{}
+	for _, bin := range bins {
+		box.count += bin.count
+		for c, v := range bin.mean {
+			if v < lo[c] {
+				lo[c] = v
+			}
+			if v > hi[c] {
+				hi[c] = v
+			}
+		}
+	}
+	for c := range lo {
+		if w := int(hi[c]) - int(lo[c]); w > box.width {
+			box.channel, box.width = c, w
+		}
+	}
+	return box
+}
+
+// split divides the box at the median of its pixels along its widest
+// channel.
+func (box colorBox) split() (colorBox, colorBox) {
+	sort.Slice(box.bins, func(i, j int) bool {
+		return box.bins[i].mean[box.channel] < box.bins[j].mean[box.channel]
+	})
+	// both halves keep at least one bin
+	var count uint64
+	i := 1
+	for ; i < len(box.bins)-1; i++ {
+		count += box.bins[i-1].count
+		if count*2 >= box.count {
+			break
+		}
+	}
+	return newColorBox(box.bins[:i]), newColorBox(box.bins[i:])
+}
+
+// color returns the average color of the box.
+func (box colorBox) color() color.NRGBA {
+	var r, g, b, a uint64
+	for _, bin := range box.bins {
+		r, g, b, a = r+bin.r, g+bin.g, b+bin.b, a+bin.a
+	}
+	n := box.count
+	return color.NRGBAModel.Convert(color.RGBA{
+		R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n),
+	}).(color.NRGBA)
+}
+
+// medianCut returns a palette of at most numColors colors for the histogram.
+func medianCut(hist []*histogramBin, numColors int) color.Palette {
+	if len(hist) == 0 {
+		return color.Palette{color.NRGBA{}}
+	}
+	boxes := medianCutBoxes(hist, numColors)
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		palette[i] = opaqueOrClear(box.color())
+	}
+	return palette
+}
+
+// medianCutBoxes divides the histogram into at most numColors boxes. The box
+// with the most pixels times range is split until there are enough boxes or
+// none can be split.
+func medianCutBoxes(hist []*histogramBin, numColors int) []colorBox {
+	boxes := []colorBox{newColorBox(hist)}
+	for len(boxes) < numColors {
+		best := -1
+		var bestScore uint64
+		for i, box := range boxes {
+			if score := box.count * uint64(box.width); score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		lower, upper := boxes[best].split()
+		boxes[best] = lower
+		boxes = append(boxes, upper)
+	}
+	return boxes
+}
+
+// nearestColor returns the index of the palette color closest to c,
+// compared premultiplied so that colors that are almost transparent are
+// close to each other.
+func nearestColor(palette color.Palette, c color.NRGBA) int {
+	r, g, b, a := c.RGBA()
+	best, bestDist := 0, uint64(1<<63)
+	for i, p := range palette {
+		pr, pg, pb, pa := p.RGBA()
+		dist := sqDiff(r, pr) + sqDiff(g, pg) + sqDiff(b, pb) + sqDiff(a, pa)
+		if dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+// sqDiff returns the squared difference of two 16 bit color channels.
+func sqDiff(x, y uint32) uint64 {
+	d := int64(x>>8) - int64(y>>8)
+	return uint64(d * d)
+}
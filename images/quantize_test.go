@@ -0,0 +1,157 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func Test_quantize(t *testing.T) {
+	t.Parallel()
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	halfGreen := color.NRGBA{0, 255, 0, 128}
+
+	img := image.NewNRGBA(image.Rect(10, 10, 40, 30))
+	for y := 10; y < 30; y++ {
+		for x := 10; x < 40; x++ {
+			switch {
+			case x < 20:
+				img.SetNRGBA(x, y, red)
+			case x < 30:
+				img.SetNRGBA(x, y, blue)
+			case y < 20:
+				img.SetNRGBA(x, y, halfGreen)
+			}
+		}
+	}
+
+	got := quantize(img, 256, DitherNone)
+	if got.Rect != image.Rect(0, 0, 30, 20) {
+		t.Errorf("quantize() bounds = %v, want them moved to 0,0", got.Rect)
+	}
+	if len(got.Palette) != 4 {
+		t.Errorf("quantize() palette = %v, want the 4 colors of the image", got.Palette)
+	}
+	want := map[image.Point]color.NRGBA{
+		{0, 0}:   red,
+		{10, 0}:  blue,
+		{20, 0}:  halfGreen,
+		{20, 15}: {},
+	}
+	for p, c := range want {
+		if at := got.At(p.X, p.Y).(color.NRGBA); at != c {
+			t.Errorf("quantize() at %v = %v, want %v", p, at, c)
+		}
+	}
+
+	got = quantize(noiseImage(64, 64), 16, DitherNone)
+	if len(got.Palette) != 16 {
+		t.Errorf("quantize() of noise has %d colors, want 16", len(got.Palette))
+	}
+	// one color covering most of the image
+	mostlyRed := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < len(mostlyRed.Pix); i += 4 {
+		copy(mostlyRed.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+	mostlyRed.SetNRGBA(3, 3, blue)
+	got = quantize(mostlyRed, 8, DitherNone)
+	if len(got.Palette) != 2 || got.At(3, 3).(color.NRGBA) != blue {
+		t.Errorf("quantize() palette = %v, want red and blue", got.Palette)
+	}
+	got = quantize(img, 1, DitherNone)
+	if len(got.Palette) != 2 {
+		t.Errorf("quantize() with 1 color has %d colors, want at least 2", len(got.Palette))
+	}
+}
+
+func Test_ditherTo(t *testing.T) {
+	t.Parallel()
+	// flat gray between black and white
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			v := uint8(0)
+			if x >= 24 {
+				v = 255
+			} else if x >= 8 {
+				v = 128
+			}
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+
+	// the mean brightness of the gray area, 0 to 1
+	grayMean := func(p *image.Paletted) float64 {
+		sum := 0.0
+		for y := 0; y < 32; y++ {
+			for x := 8; x < 24; x++ {
+				r, _, _, _ := p.At(x, y).RGBA()
+				sum += float64(r) / 0xffff
+			}
+		}
+		return sum / (32 * 16)
+	}
+
+	blackWhite := color.Palette{color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}}
+	none := image.NewPaletted(img.Rect, blackWhite)
+	ditherTo(none, img, DitherNone)
+	if m := grayMean(none); m != 0 && m != 1 {
+		t.Errorf("ditherTo() without dithering gives a mean of %g in the gray area, want it flat", m)
+	}
+	for _, d := range []Dither{DitherFloydSteinberg, DitherOrdered} {
+		got := image.NewPaletted(img.Rect, blackWhite)
+		ditherTo(got, img, d)
+		if m := grayMean(got); math.Abs(m-0.5) > 0.1 {
+			t.Errorf("ditherTo() with %s dithering gives a mean of %g in the gray area, want about 0.5", d, m)
+		}
+		if got.ColorIndexAt(0, 0) != 0 || got.ColorIndexAt(31, 31) != 1 {
+			t.Errorf("ditherTo() with %s dithering changed black or white", d)
+		}
+	}
+}
+
+func TestParseDither(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{"none", "fs", "ordered"} {
+		if d, err := ParseDither(s); err != nil || d.String() != s {
+			t.Errorf("ParseDither(%q) = %q, %v", s, d, err)
+		}
+	}
+	if _, err := ParseDither("bayer"); err == nil {
+		t.Error("ParseDither(\"bayer\") expected an error")
+	}
+}
+
+func Test_binaryAlpha(t *testing.T) {
+	t.Parallel()
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 100})
+	img.SetNRGBA(1, 0, color.NRGBA{255, 0, 0, 200})
+	got := binaryAlpha(img)
+	for x, want := range []uint8{0, 255, 0} {
+		if a := color.NRGBAModel.Convert(got.At(x, 0)).(color.NRGBA).A; a != want {
+			t.Errorf("binaryAlpha() alpha at %d = %d, want %d", x, a, want)
+		}
+	}
+}
+
+func Test_pngCompression(t *testing.T) {
+	t.Parallel()
+	img := image.NewGray(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 7 * 30)
+	}
+	fast, best := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := encodeImage(fast, img, ImageParameters{Format: Png, Quality: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeImage(best, img, ImageParameters{Format: Png, Quality: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if best.Len() > fast.Len() {
+		t.Errorf("compression level 9 gave %d bytes, level 1 %d bytes", best.Len(), fast.Len())
+	}
+}
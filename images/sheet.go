@@ -0,0 +1,304 @@
+package images
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/johan-st/go-image-server/units/size"
+)
+
+const (
+	// largest number of images in a sheet
+	MaxSheetImages = 100
+	// largest width or height of a sheet in pixels, lowered by the max
+	// dimension of the image defaults if set
+	MaxSheetDimension = 4096
+	// cache entries of sheets are kept under this id, as they are made of
+	// several originals. Ids of originals start at 1.
+	sheetCacheId = 0
+)
+
+// SheetParameters describes a contact sheet: a grid of originals, each fitted
+// into a cell of the same size.
+type SheetParameters struct {
+	// originals in the order they are placed, left to right and top to
+	// bottom. An id may be given more than once.
+	Ids []int
+	// number of columns (0 = as many as make the grid square)
+	Cols int
+
+	// size of each cell in pixels
+	CellWidth  uint
+	CellHeight uint
+
+	Format
+	// as for ImageParameters
+	Quality int
+
+	// how each image is fitted into its cell. Images that do not fill their
+	// cell are centered on Background.
+	Fit Fit
+	// color of the parts of cells not covered by an image (zero value =
+	// the default background, transparent if the format supports it and
+	// white otherwise)
+	Background color.NRGBA
+	// Background was given, also if it is transparent
+	BackgroundSet bool
+	Interpolation Interpolation
+}
+
+// SheetCell is the position of an image within a sheet, in pixels.
+type SheetCell struct {
+	Id     int `json:"id"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Sheet returns the path to the contact sheet described by sp and the
+// position of each image in it. Sheets are cached like other images and
+// removed when any original is deleted or gets a new focal point.
+func (h *ImageHandler) Sheet(sp SheetParameters) (string, []SheetCell, error) {
+	sp.apply(h.opts.imageDefaults)
+	err := sp.validate(h.opts.imageDefaults.MaxDimension)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, id := range sp.Ids {
+		_, err := h.originalPath(id)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	cells := sp.Cells()
+	cachePath := filepath.Join(h.opts.dirCache, sp.String())
+	h.opts.l.Debug("Sheet", "SheetParameters", sp, "cachePath", cachePath)
+	if h.cache.Contains(cachePath) {
+		h.cache.AddOrUpdate(sheetCacheId, cachePath)
+		return cachePath, cells, nil
+	}
+
+	size, err := h.createSheet(sp, cells, cachePath)
+	if err != nil {
+		return "", nil, err
+	}
+	h.cache.AddOrUpdate(sheetCacheId, cachePath)
+	h.opts.l.Debug("Sheet created", "path", cachePath, "size", size)
+	return cachePath, cells, nil
+}
+
+// createSheet renders every cell of the sheet and writes the result to the
+// cache. Each id is rendered once, in parallel.
+func (h *ImageHandler) createSheet(sp SheetParameters, cells []SheetCell, cachePath string) (size.S, error) {
+	// ids repeated in the sheet share one rendering
+	ids := []int{}
+	index := map[int]int{}
+	for _, id := range sp.Ids {
+		if _, ok := index[id]; !ok {
+			index[id] = len(ids)
+			ids = append(ids, id)
+		}
+	}
+	rendered := make([]image.Image, len(ids))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, id int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			img, err := h.renderCell(sp, id)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			// each goroutine writes only its own element
+			rendered[i] = img
+		}(i, id)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	width, height := sp.Size()
+	sheet := image.NewNRGBA(image.Rect(0, 0, width, height))
+	bg := background(sp.cellParameters(0))
+	draw.Draw(sheet, sheet.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	for _, cell := range cells {
+		// centered, for fits that do not fill the cell
+		img := rendered[index[cell.Id]]
+		b := img.Bounds()
+		offset := image.Pt(cell.X+(cell.Width-b.Dx())/2, cell.Y+(cell.Height-b.Dy())/2)
+		draw.Draw(sheet, b.Sub(b.Min).Add(offset), img, b.Min, draw.Over)
+	}
+
+	params := sp.cellParameters(0)
+	params.Dither = h.opts.imageDefaults.Dither
+	buf := &bytes.Buffer{}
+	err := encodeImage(buf, sheet, params)
+	if err != nil {
+		return 0, err
+	}
+	return h.writeCacheFile(cachePath, buf.Bytes())
+}
+
+// renderCell returns the original with the given id fitted into a cell,
+// cropped around its focal point if needed.
+func (h *ImageHandler) renderCell(sp SheetParameters, id int) (image.Image, error) {
+	params := sp.cellParameters(id)
+	focus, err := h.Focus(id)
+	if err != nil {
+		return nil, err
+	}
+	params.focus = &focus
+
+	oImg, err := h.loadOriginal(id)
+	if err != nil {
+		return nil, err
+	}
+	process, err := h.renderer(oImg, params)
+	if err != nil {
+		return nil, err
+	}
+	return process(params.Width, params.Height)
+}
+
+// cellParameters returns the parameters each cell is rendered with.
+func (sp SheetParameters) cellParameters(id int) ImageParameters {
+	return ImageParameters{
+		Id:            id,
+		Format:        sp.Format,
+		Quality:       sp.Quality,
+		Width:         sp.CellWidth,
+		Height:        sp.CellHeight,
+		Interpolation: sp.Interpolation,
+		Fit:           sp.Fit,
+		Background:    sp.Background,
+		BackgroundSet: sp.BackgroundSet,
+	}
+}
+
+// apply sets the values of sp that are not set from def.
+func (sp *SheetParameters) apply(def ImageDefaults) {
+	ip := sp.cellParameters(0)
+	ip.apply(def)
+	sp.Format, sp.Quality, sp.Fit = ip.Format, ip.Quality, ip.Fit
+	sp.Background, sp.Interpolation = ip.Background, ip.Interpolation
+	if sp.Cols == 0 && len(sp.Ids) > 0 {
+		sp.Cols = int(math.Ceil(math.Sqrt(float64(len(sp.Ids)))))
+	}
+}
+
+// validate returns an error if the sheet can not be created. A maxDimension
+// above 0 lowers the largest width and height of the sheet.
+func (sp SheetParameters) validate(maxDimension int) error {
+	if len(sp.Ids) == 0 || len(sp.Ids) > MaxSheetImages {
+		return ErrInvalidSheet{Reason: fmt.Sprintf("a sheet must have 1 to %d images, got %d", MaxSheetImages, len(sp.Ids))}
+	}
+	if sp.Cols < 1 {
+		return ErrInvalidSheet{Reason: fmt.Sprintf("a sheet must have at least one column, got %d", sp.Cols)}
+	}
+	if sp.CellWidth == 0 || sp.CellHeight == 0 {
+		return ErrInvalidSheet{Reason: "cell width and height must both be set"}
+	}
+	max := MaxSheetDimension
+	if maxDimension > 0 && maxDimension < max {
+		max = maxDimension
+	}
+	if w, h := sp.Size(); w > max || h > max {
+		return ErrInvalidSheet{Reason: fmt.Sprintf("a sheet can be at most %d pixels wide and high, got %dx%d", max, w, h)}
+	}
+	return nil
+}
+
+// Size returns the width and height of the sheet in pixels. Columns beyond
+// the number of images are left out.
+func (sp SheetParameters) Size() (int, int) {
+	cols := sp.Cols
+	if cols > len(sp.Ids) {
+		cols = len(sp.Ids)
+	}
+	if cols < 1 {
+		return 0, 0
+	}
+	rows := (len(sp.Ids) + cols - 1) / cols
+	return cols * int(sp.CellWidth), rows * int(sp.CellHeight)
+}
+
+// Cells returns the position of each image in the sheet, in the order of
+// Ids.
+func (sp SheetParameters) Cells() []SheetCell {
+	if sp.Cols < 1 {
+		return []SheetCell{}
+	}
+	cells := make([]SheetCell, len(sp.Ids))
+	w, h := int(sp.CellWidth), int(sp.CellHeight)
+	for i, id := range sp.Ids {
+		cells[i] = SheetCell{Id: id, X: i % sp.Cols * w, Y: i / sp.Cols * h, Width: w, Height: h}
+	}
+	return cells
+}
+
+// String returns the cache key of the sheet. The ids are hashed to keep file
+// names short.
+func (sp SheetParameters) String() string {
+	ids := make([]string, len(sp.Ids))
+	for i, id := range sp.Ids {
+		ids[i] = strconv.Itoa(id)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+
+	strB := strings.Builder{}
+	strB.WriteString(fmt.Sprintf("sheet_%s_%dc_%dx%d_q%d", hex.EncodeToString(sum[:8]), sp.Cols, sp.CellWidth, sp.CellHeight, sp.Quality))
+	if sp.Interpolation != "" {
+		strB.WriteString(fmt.Sprintf("_i%s", sp.Interpolation))
+	}
+	if sp.Fit != "" && sp.Fit != FitCover {
+		strB.WriteString(fmt.Sprintf("_%s", sp.Fit))
+	}
+	if sp.cellParameters(0).hasBackground() {
+		bg := sp.Background
+		strB.WriteString(fmt.Sprintf("_bg%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A))
+	}
+	strB.WriteString(fmt.Sprintf(".%s", sp.Format))
+	return strB.String()
+}
+
+// ErrInvalidSheet is returned when a sheet can not be created as described.
+type ErrInvalidSheet struct {
+	Reason string
+}
+
+func (e ErrInvalidSheet) Error() string {
+	return fmt.Sprintf("invalid sheet: %s", e.Reason)
+}
+
+func (e ErrInvalidSheet) Is(err error) bool {
+	_, ok := err.(ErrInvalidSheet)
+	return ok
+}
@@ -0,0 +1,98 @@
+package images
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSheetParameters_Cells(t *testing.T) {
+	t.Parallel()
+	sp := SheetParameters{Ids: []int{3, 1, 2, 3, 5}, Cols: 2, CellWidth: 100, CellHeight: 50}
+
+	want := []SheetCell{
+		{Id: 3, X: 0, Y: 0, Width: 100, Height: 50},
+		{Id: 1, X: 100, Y: 0, Width: 100, Height: 50},
+		{Id: 2, X: 0, Y: 50, Width: 100, Height: 50},
+		{Id: 3, X: 100, Y: 50, Width: 100, Height: 50},
+		{Id: 5, X: 0, Y: 100, Width: 100, Height: 50},
+	}
+	got := sp.Cells()
+	if len(got) != len(want) {
+		t.Fatalf("Cells() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Cells()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if w, h := sp.Size(); w != 200 || h != 150 {
+		t.Errorf("Size() = %dx%d, want 200x150", w, h)
+	}
+
+	// unused columns are left out
+	sp = SheetParameters{Ids: []int{1, 2}, Cols: 4, CellWidth: 100, CellHeight: 50}
+	if w, h := sp.Size(); w != 200 || h != 50 {
+		t.Errorf("Size() = %dx%d, want 200x50", w, h)
+	}
+}
+
+func TestSheetParameters_apply(t *testing.T) {
+	t.Parallel()
+	def := optionsDefault().imageDefaults
+
+	sp := SheetParameters{Ids: []int{1, 2, 3, 4, 5}, CellWidth: 10, CellHeight: 10}
+	sp.apply(def)
+	if sp.Cols != 3 || sp.Format != def.Format || sp.Quality != def.QualityJpeg || sp.Fit != def.Fit {
+		t.Errorf("apply() = %+v, want 3 columns and the defaults", sp)
+	}
+}
+
+func TestSheetParameters_validate(t *testing.T) {
+	t.Parallel()
+	ids := make([]int, MaxSheetImages+1)
+	tests := []struct {
+		name string
+		sp   SheetParameters
+	}{
+		{"no ids", SheetParameters{Cols: 1, CellWidth: 10, CellHeight: 10}},
+		{"too many ids", SheetParameters{Ids: ids, Cols: 1, CellWidth: 10, CellHeight: 10}},
+		{"no cell height", SheetParameters{Ids: []int{1}, Cols: 1, CellWidth: 10}},
+		{"too wide", SheetParameters{Ids: []int{1, 2}, Cols: 2, CellWidth: MaxSheetDimension, CellHeight: 10}},
+	}
+	for _, tt := range tests {
+		if err := tt.sp.validate(0); !errors.Is(err, ErrInvalidSheet{}) {
+			t.Errorf("%s: validate() = %v, want ErrInvalidSheet", tt.name, err)
+		}
+	}
+	if err := (SheetParameters{Ids: []int{1}, Cols: 1, CellWidth: 10, CellHeight: 10}).validate(0); err != nil {
+		t.Errorf("validate() = %v, want no error", err)
+	}
+
+	// max_dimension lowers the limit, but never raises it
+	wide := SheetParameters{Ids: []int{1, 2}, Cols: 2, CellWidth: 300, CellHeight: 10}
+	if err := wide.validate(500); !errors.Is(err, ErrInvalidSheet{}) {
+		t.Errorf("validate(500) = %v, want ErrInvalidSheet for a 600 pixel wide sheet", err)
+	}
+	if err := wide.validate(1000); err != nil {
+		t.Errorf("validate(1000) = %v, want no error", err)
+	}
+	huge := SheetParameters{Ids: []int{1}, Cols: 1, CellWidth: MaxSheetDimension + 1, CellHeight: 10}
+	if err := huge.validate(MaxSheetDimension * 2); !errors.Is(err, ErrInvalidSheet{}) {
+		t.Errorf("validate() = %v, want ErrInvalidSheet above MaxSheetDimension", err)
+	}
+}
+
+func TestSheetParameters_String(t *testing.T) {
+	t.Parallel()
+	a := SheetParameters{Ids: []int{1, 2, 3}, Cols: 2, CellWidth: 100, CellHeight: 100, Format: Jpeg, Quality: 80}
+	b := a
+	b.Ids = []int{3, 2, 1}
+
+	if a.String() == b.String() {
+		t.Errorf("String() is the same for ids in a different order: %s", a)
+	}
+	if !strings.HasPrefix(a.String(), "sheet_") || !strings.HasSuffix(a.String(), "_2c_100x100_q80.jpeg") {
+		t.Errorf("String() = %s", a)
+	}
+}
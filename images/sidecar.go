@@ -0,0 +1,105 @@
+package images
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sidecarExt is the extension of files stored next to originals holding
+// data about them.
+const sidecarExt = ".json"
+
+// sidecar holds data about an original. It is stored as "<id>.json" in the
+// originals directory.
+type sidecar struct {
+	// hex encoded SHA-256 of the file as it was added
+	Sha256 string `json:"sha256,omitempty"`
+	// perceptual hash, see similar.go
+	DHash       string       `json:"dhash,omitempty"`
+	Info        *Info        `json:"info,omitempty"`
+	Focus       *FocalPoint  `json:"focus,omitempty"`
+	Placeholder *Placeholder `json:"placeholder,omitempty"`
+	// by palette size
+	Colors map[int]Colors `json:"colors,omitempty"`
+}
+
+func (h *ImageHandler) sidecarPath(id int) string {
+	return filepath.Join(h.opts.dirOriginals, strconv.Itoa(id)+sidecarExt)
+}
+
+// readSidecar returns the sidecar of the given id. An empty sidecar is
+// returned if none has been stored. Sidecars are kept in memory once read.
+func (h *ImageHandler) readSidecar(id int) (sidecar, error) {
+	h.sidecarMu.Lock()
+	defer h.sidecarMu.Unlock()
+	return h.readSidecarLocked(id)
+}
+
+func (h *ImageHandler) readSidecarLocked(id int) (sidecar, error) {
+	if sc, ok := h.sidecars[id]; ok {
+		return sc, nil
+	}
+
+	sc := sidecar{}
+	data, err := os.ReadFile(h.sidecarPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return sc, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &sc)
+		if err != nil {
+			return sc, err
+		}
+	}
+	h.sidecars[id] = sc
+	return sc, nil
+}
+
+// updateSidecar applies fn to the sidecar of the given id and stores the
+// result.
+func (h *ImageHandler) updateSidecar(id int, fn func(*sidecar)) error {
+	h.sidecarMu.Lock()
+	defer h.sidecarMu.Unlock()
+
+	sc, err := h.readSidecarLocked(id)
+	if err != nil {
+		return err
+	}
+	fn(&sc)
+
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write and rename to never leave a partial file behind
+	path := h.sidecarPath(id)
+	tmp := strings.TrimSuffix(path, sidecarExt) + ".tmp" + sidecarExt
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	h.sidecars[id] = sc
+	return nil
+}
+
+// deleteSidecar removes the sidecar of the given id, if any.
+func (h *ImageHandler) deleteSidecar(id int) error {
+	h.sidecarMu.Lock()
+	defer h.sidecarMu.Unlock()
+
+	delete(h.sidecars, id)
+	err := os.Remove(h.sidecarPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
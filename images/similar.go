@@ -0,0 +1,169 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// largest hamming distance of images returned by Similar when none is
+	// requested
+	DefaultSimilarDistance = 10
+	// number of bits in a perceptual hash, the largest possible distance
+	MaxHashDistance = 64
+)
+
+// Similar is an original that looks like the one searched for.
+type Similar struct {
+	Id int `json:"id"`
+	// number of bits that differ between the perceptual hashes, 0 for
+	// visually identical images
+	Distance int `json:"distance"`
+}
+
+// Similar returns the originals whose perceptual hash differs from the one of
+// the given id in at most maxDistance bits, closest first and then by id.
+// Resized and re-encoded copies are usually within 10 bits. Hashes are
+// computed once per original and stored with it, see loadDHashes.
+func (h *ImageHandler) Similar(id int, maxDistance int) ([]Similar, error) {
+	if maxDistance < 0 || maxDistance > MaxHashDistance {
+		return nil, ErrInvalidDistance{Distance: maxDistance}
+	}
+	hash, err := h.dHash(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := h.Ids()
+	if err != nil {
+		return nil, err
+	}
+	similar := []Similar{}
+	for _, other := range ids {
+		if other == id {
+			continue
+		}
+		otherHash, err := h.dHash(other)
+		if errors.Is(err, ErrIdNotFound{}) {
+			// deleted while searching
+			continue
+		}
+		if err != nil {
+			h.opts.l.Warn("could not compute perceptual hash", "id", other, "error", err)
+			continue
+		}
+		d := bits.OnesCount64(hash ^ otherHash)
+		if d <= maxDistance {
+			similar = append(similar, Similar{Id: other, Distance: d})
+		}
+	}
+
+	// ties are ordered by id to give the same order on every search
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].Id < similar[j].Id
+	})
+	return similar, nil
+}
+
+// loadDHashes computes the perceptual hashes missing from originals added
+// before they were recorded, so that searches do not have to. Originals that
+// can not be hashed are logged and hashed again on search.
+func (h *ImageHandler) loadDHashes() error {
+	ids, err := h.Ids()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		sc, err := h.readSidecar(id)
+		if err != nil {
+			return fmt.Errorf("could not read sidecar of id %d: %w", id, err)
+		}
+		if sc.DHash != "" {
+			continue
+		}
+		_, err = h.dHash(id)
+		if err != nil {
+			h.opts.l.Warn("could not compute perceptual hash", "id", id, "error", err)
+		}
+	}
+	return nil
+}
+
+// dHash returns the perceptual hash of the original with the given id,
+// computing and storing it if needed.
+func (h *ImageHandler) dHash(id int) (uint64, error) {
+	_, err := h.originalPath(id)
+	if err != nil {
+		return 0, err
+	}
+	sc, err := h.readSidecar(id)
+	if err != nil {
+		return 0, err
+	}
+	if sc.DHash != "" {
+		hash, err := strconv.ParseUint(sc.DHash, 16, 64)
+		if err == nil {
+			return hash, nil
+		}
+		h.opts.l.Warn("recomputing invalid perceptual hash", "id", id, "dHash", sc.DHash)
+	}
+
+	img, err := h.loadOriginal(id)
+	if err != nil {
+		return 0, err
+	}
+	hash := dHash(img)
+	err = h.updateSidecar(id, func(sc *sidecar) {
+		sc.DHash = fmt.Sprintf("%016x", hash)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not store perceptual hash: %w", err)
+	}
+	return hash, nil
+}
+
+// dHash returns the difference hash of img: it is scaled to 9x8 pixels and
+// every bit tells if a pixel is brighter than its right neighbour. Scaling
+// and encoding barely change it.
+func dHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	b := small.Bounds()
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+			right := color.GrayModel.Convert(small.At(b.Min.X+x+1, b.Min.Y+y)).(color.Gray)
+			hash <<= 1
+			if left.Y > right.Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// ErrInvalidDistance is returned when similar images are searched for with a
+// distance outside of what a hash can differ by.
+type ErrInvalidDistance struct {
+	Distance int
+}
+
+func (e ErrInvalidDistance) Error() string {
+	return fmt.Sprintf("invalid distance. \n\tGot: '%d'\n\tWant: 0 to %d (inclusive)", e.Distance, MaxHashDistance)
+}
+
+func (e ErrInvalidDistance) Is(err error) bool {
+	_, ok := err.(ErrInvalidDistance)
+	return ok
+}
@@ -0,0 +1,42 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+func Test_dHash(t *testing.T) {
+	t.Parallel()
+	// bright on the left, dark on the right
+	gradient := image.NewGray(image.Rect(0, 0, 180, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 180; x++ {
+			gradient.SetGray(x, y, color.Gray{Y: uint8(255 - x)})
+		}
+	}
+	if got := dHash(gradient); got != 1<<64-1 {
+		t.Errorf("dHash() of a falling gradient = %016x, want all bits set", got)
+	}
+	if got := dHash(image.NewGray(image.Rect(0, 0, 90, 80))); got != 0 {
+		t.Errorf("dHash() of a flat image = %016x, want no bits set", got)
+	}
+
+	// resized copies are close
+	blocks := image.NewGray(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			blocks.SetGray(x, y, color.Gray{Y: uint8((x/37*71 + y/29*113) % 256)})
+		}
+	}
+	small := resize.Resize(130, 0, blocks, resize.Lanczos3)
+	if d := bits.OnesCount64(dHash(blocks) ^ dHash(small)); d > DefaultSimilarDistance {
+		t.Errorf("dHash() of a resized copy differs in %d bits", d)
+	}
+	if d := bits.OnesCount64(dHash(blocks) ^ dHash(gradient)); d <= DefaultSimilarDistance {
+		t.Errorf("dHash() of different images differs in only %d bits", d)
+	}
+}
@@ -0,0 +1,259 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+)
+
+// bakeQuality is the quality used when lossy originals are re-encoded.
+const bakeQuality = 95
+
+// Orientations as defined by the exif Orientation tag. The name describes
+// what needs to be done to the stored pixels for the image to be upright.
+const (
+	orientNormal     = 1
+	orientFlipH      = 2
+	orientRotate180  = 3
+	orientFlipV      = 4
+	orientTranspose  = 5
+	orientRotate90   = 6 // clockwise
+	orientTransverse = 7
+	orientRotate270  = 8 // clockwise
+)
+
+// applyOrientation returns img transformed according to the given exif
+// orientation. img is returned as is for orientation 1 (normal) or unknown
+// orientations.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= orientNormal || orientation > orientRotate270 {
+		return img
+	}
+
+	src := toNRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	// swap width and height if the image is rotated by 90 or 270 degrees
+	dw, dh := w, h
+	if orientation >= orientTranspose {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case orientFlipH:
+				sx, sy = w-1-x, y
+			case orientRotate180:
+				sx, sy = w-1-x, h-1-y
+			case orientFlipV:
+				sx, sy = x, h-1-y
+			case orientTranspose:
+				sx, sy = y, x
+			case orientRotate90:
+				sx, sy = y, h-1-x
+			case orientTransverse:
+				sx, sy = w-1-y, h-1-x
+			case orientRotate270:
+				sx, sy = w-1-y, x
+			}
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// Rotation is a clockwise rotation in degrees applied to an image.
+type Rotation uint
+
+const (
+	Rotate0   Rotation = 0
+	Rotate90  Rotation = 90
+	Rotate180 Rotation = 180
+	Rotate270 Rotation = 270
+)
+
+func (r Rotation) String() string {
+	return fmt.Sprintf("%d", r)
+}
+
+func ParseRotation(s string) (Rotation, error) {
+	switch s {
+	case "0":
+		return Rotate0, nil
+	case "90":
+		return Rotate90, nil
+	case "180":
+		return Rotate180, nil
+	case "270":
+		return Rotate270, nil
+	}
+	return 0, fmt.Errorf("invalid rotation. \n\tGot: '%s'\n\tWant: '0', '90', '180', '270'", s)
+}
+
+// Flip mirrors an image horizontally, vertically or both. It is applied
+// after the rotation.
+type Flip string
+
+const (
+	FlipNone Flip = ""
+	FlipH    Flip = "h"  // left to right
+	FlipV    Flip = "v"  // top to bottom
+	FlipHV   Flip = "hv" // both, the same as a rotation by 180 degrees
+)
+
+func (f Flip) String() string {
+	return string(f)
+}
+
+func ParseFlip(s string) (Flip, error) {
+	switch s {
+	case "h":
+		return FlipH, nil
+	case "v":
+		return FlipV, nil
+	case "hv", "vh":
+		return FlipHV, nil
+	}
+	return "", fmt.Errorf("invalid flip. \n\tGot: '%s'\n\tWant: 'h', 'v', 'hv'", s)
+}
+
+// transformOrientations is indexed by rotation / 90 and flip.
+var transformOrientations = [4]map[Flip]int{
+	{FlipNone: orientNormal, FlipH: orientFlipH, FlipV: orientFlipV, FlipHV: orientRotate180},
+	{FlipNone: orientRotate90, FlipH: orientTranspose, FlipV: orientTransverse, FlipHV: orientRotate270},
+	{FlipNone: orientRotate180, FlipH: orientFlipV, FlipV: orientFlipH, FlipHV: orientNormal},
+	{FlipNone: orientRotate270, FlipH: orientTransverse, FlipV: orientTranspose, FlipHV: orientRotate90},
+}
+
+// transformOrientation returns the exif orientation that rotates and then
+// flips an image as given.
+func transformOrientation(rot Rotation, flip Flip) int {
+	o, ok := transformOrientations[(rot/90)%4][flip]
+	if !ok {
+		return orientNormal
+	}
+	return o
+}
+
+// orientPoint returns where the point (x, y) of an area of w x h ends up
+// when the area is transformed according to the given exif orientation.
+func orientPoint(x, y, w, h float64, orientation int) (float64, float64) {
+	switch orientation {
+	case orientFlipH:
+		return w - x, y
+	case orientRotate180:
+		return w - x, h - y
+	case orientFlipV:
+		return x, h - y
+	case orientTranspose:
+		return y, x
+	case orientRotate90:
+		return h - y, x
+	case orientTransverse:
+		return h - y, w - x
+	case orientRotate270:
+		return y, w - x
+	}
+	return x, y
+}
+
+// orientFocus returns the focal point moved along with the image when it is
+// transformed according to the given exif orientation.
+func orientFocus(fp FocalPoint, orientation int) FocalPoint {
+	x, y := orientPoint(fp.X, fp.Y, 1, 1, orientation)
+	return FocalPoint{X: x, Y: y}
+}
+
+// orientRect returns where r, a part of bounds starting at (0, 0), ends up
+// when bounds is transformed according to the given exif orientation.
+func orientRect(r, bounds image.Rectangle, orientation int) image.Rectangle {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	x0, y0 := orientPoint(float64(r.Min.X), float64(r.Min.Y), w, h, orientation)
+	x1, y1 := orientPoint(float64(r.Max.X), float64(r.Max.Y), w, h, orientation)
+	return image.Rect(int(x0), int(y0), int(x1), int(y1))
+}
+
+// orientGif returns anim with every frame transformed according to the given
+// exif orientation. The canvas of anim is expected to start at (0, 0).
+func orientGif(anim *gif.GIF, orientation int) *gif.GIF {
+	if orientation <= orientNormal || orientation > orientRotate270 {
+		return anim
+	}
+
+	canvas := gifCanvas(anim)
+	w, h := float64(canvas.Dx()), float64(canvas.Dy())
+	dw, dh := w, h
+	if orientation >= orientTranspose {
+		dw, dh = h, w
+	}
+	// the inverse maps points of the result back to anim
+	inverse := orientation
+	switch orientation {
+	case orientRotate90:
+		inverse = orientRotate270
+	case orientRotate270:
+		inverse = orientRotate90
+	}
+
+	out := *anim
+	out.Config.Width, out.Config.Height = int(dw), int(dh)
+	out.Image = make([]*image.Paletted, len(anim.Image))
+	for i, frame := range anim.Image {
+		r := orientRect(frame.Rect, canvas, orientation)
+		dst := image.NewPaletted(r, frame.Palette)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				// sample at the center of the pixel
+				sx, sy := orientPoint(float64(x)+0.5, float64(y)+0.5, dw, dh, inverse)
+				dst.SetColorIndex(x, y, frame.ColorIndexAt(int(math.Floor(sx)), int(math.Floor(sy))))
+			}
+		}
+		out.Image[i] = dst
+	}
+	return &out
+}
+
+// toNRGBA returns img as an *image.NRGBA with its bounds starting at (0, 0).
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	if nrgba, ok := img.(*image.NRGBA); ok && b.Min == (image.Point{}) {
+		return nrgba
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	return dst
+}
+
+// bakeOrientation returns the image read from rs with its exif orientation
+// applied to the pixel data. The image is re-encoded in format, dropping
+// its metadata. If no change is needed rs is returned, positioned at start.
+func bakeOrientation(rs io.ReadSeeker, format Format) (io.Reader, error) {
+	orientation := readOrientation(rs)
+	_, err := rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	if orientation == orientNormal {
+		return rs, nil
+	}
+
+	img, _, err := image.Decode(rs)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	err = encodeImage(buf, applyOrientation(img, orientation), ImageParameters{Format: format, Quality: bakeQuality})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,196 @@
+package images
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+)
+
+// Gravity is the edge or corner of an image a watermark is placed at.
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "center"
+	GravityNorth     Gravity = "north"
+	GravitySouth     Gravity = "south"
+	GravityEast      Gravity = "east"
+	GravityWest      Gravity = "west"
+	GravityNorthEast Gravity = "northeast"
+	GravityNorthWest Gravity = "northwest"
+	GravitySouthEast Gravity = "southeast"
+	GravitySouthWest Gravity = "southwest"
+)
+
+func (g Gravity) String() string {
+	return string(g)
+}
+
+func ParseGravity(s string) (Gravity, error) {
+	switch g := Gravity(s); g {
+	case GravityCenter, GravityNorth, GravitySouth, GravityEast, GravityWest,
+		GravityNorthEast, GravityNorthWest, GravitySouthEast, GravitySouthWest:
+		return g, nil
+	}
+	return "", fmt.Errorf("invalid gravity. \n\tGot: '%s'\n\tWant: 'center', 'north', 'south', 'east', 'west', 'northeast', 'northwest', 'southeast', 'southwest'", s)
+}
+
+// Watermark is an image composited onto created images. The zero value
+// means no watermark.
+type Watermark struct {
+	// image file on disk
+	Path string
+	// where the watermark is placed (zero value = southeast)
+	Gravity Gravity
+	// distance to the edges in pixels
+	Margin int
+	// 0 to 1 (0 = opaque)
+	Opacity float64
+	// width relative to the width of the image, 0 to 1 (0 = the size of the
+	// watermark file). Watermarks never exceed the image.
+	Scale float64
+	// set for watermarks that can not be removed through the url
+	Locked bool
+}
+
+// IsZero reports whether no watermark is set.
+func (wm Watermark) IsZero() bool {
+	return wm.Path == ""
+}
+
+// Validate returns an error if the watermark settings are out of range. The
+// file is not checked.
+func (wm Watermark) Validate() error {
+	if wm.Gravity != "" {
+		if _, err := ParseGravity(string(wm.Gravity)); err != nil {
+			return err
+		}
+	}
+	if wm.Margin < 0 {
+		return fmt.Errorf("invalid watermark margin. \n\tGot: '%d'\n\tWant: 0 or greater", wm.Margin)
+	}
+	if wm.Opacity < 0 || wm.Opacity > 1 || math.IsNaN(wm.Opacity) {
+		return fmt.Errorf("invalid watermark opacity. \n\tGot: '%g'\n\tWant: 0 to 1 (inclusive)", wm.Opacity)
+	}
+	if wm.Scale < 0 || wm.Scale > 1 || math.IsNaN(wm.Scale) {
+		return fmt.Errorf("invalid watermark scale. \n\tGot: '%g'\n\tWant: 0 to 1 (inclusive)", wm.Scale)
+	}
+	return nil
+}
+
+// key returns a short hash of the watermark as part of a file name.
+func (wm Watermark) key() string {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%s|%s|%d|%g|%g", wm.Path, wm.Gravity, wm.Margin, wm.Opacity, wm.Scale)
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// watermarkImage returns the decoded watermark file at path. Files are kept
+// in memory once read.
+func (h *ImageHandler) watermarkImage(path string) (image.Image, error) {
+	h.watermarkMu.Lock()
+	defer h.watermarkMu.Unlock()
+
+	if img, ok := h.watermarks[path]; ok {
+		return img, nil
+	}
+	img, err := loadImage(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load watermark: %w", err)
+	}
+	h.watermarks[path] = img
+	return img, nil
+}
+
+// watermarkRect returns where a watermark of the given size is placed within
+// bounds, scaled according to wm. Margins too large for bounds are reduced.
+func watermarkRect(bounds image.Rectangle, size image.Point, wm Watermark) image.Rectangle {
+	w, h := float64(size.X), float64(size.Y)
+	if wm.Scale > 0 {
+		s := wm.Scale * float64(bounds.Dx()) / w
+		w, h = w*s, h*s
+	}
+
+	// margins leave at least a pixel for the mark on small images
+	margin := wm.Margin
+	if m := (int(math.Min(float64(bounds.Dx()), float64(bounds.Dy()))) - 1) / 2; margin > m {
+		margin = m
+	}
+
+	// never exceed the image
+	maxW := float64(bounds.Dx() - 2*margin)
+	maxH := float64(bounds.Dy() - 2*margin)
+	if s := math.Min(maxW/w, maxH/h); s < 1 {
+		w, h = w*s, h*s
+	}
+	iw, ih := int(math.Max(1, math.Round(w))), int(math.Max(1, math.Round(h)))
+	return placeRect(bounds, image.Pt(iw, ih), wm.Gravity, margin)
+}
+
+// placeRect returns a rectangle of the given size placed within bounds at
+// gravity, margin pixels from the edges. The zero value of gravity places it
+// in the southeast corner.
+func placeRect(bounds image.Rectangle, size image.Point, gravity Gravity, margin int) image.Rectangle {
+	x := bounds.Min.X + (bounds.Dx()-size.X)/2
+	y := bounds.Min.Y + (bounds.Dy()-size.Y)/2
+	switch gravity {
+	case GravityNorthWest, GravityWest, GravitySouthWest:
+		x = bounds.Min.X + margin
+	case GravityNorthEast, GravityEast, GravitySouthEast, "":
+		x = bounds.Max.X - margin - size.X
+	}
+	switch gravity {
+	case GravityNorthWest, GravityNorth, GravityNorthEast:
+		y = bounds.Min.Y + margin
+	case GravitySouthWest, GravitySouth, GravitySouthEast, "":
+		y = bounds.Max.Y - margin - size.Y
+	}
+	return image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x+size.X, y+size.Y)}
+}
+
+// opacityMask returns the mask used to draw a watermark.
+func opacityMask(wm Watermark) image.Image {
+	if wm.Opacity == 0 {
+		return nil
+	}
+	return image.NewUniform(color.Alpha{A: uint8(math.Round(wm.Opacity * 255))})
+}
+
+// applyWatermark returns a copy of img with mark composited onto it.
+func applyWatermark(img image.Image, mark image.Image, wm Watermark, interp Interpolation) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+
+	r := watermarkRect(dst.Rect, mark.Bounds().Size(), wm)
+	scaled := fitImage(mark, uint(r.Dx()), uint(r.Dy()), fitOptions{fit: FitFill, interp: interp.function()})
+	draw.DrawMask(dst, r, scaled, scaled.Bounds().Min, opacityMask(wm), image.Point{}, draw.Over)
+	return dst
+}
+
+// watermarkGif returns anim with mark composited onto every frame.
+func watermarkGif(anim *gif.GIF, mark image.Image, wm Watermark, interp Interpolation) *gif.GIF {
+	r := watermarkRect(gifCanvas(anim), mark.Bounds().Size(), wm)
+	scaled := fitImage(mark, uint(r.Dx()), uint(r.Dy()), fitOptions{fit: FitFill, interp: interp.function()})
+	return overlayGif(anim, scaled, r, opacityMask(wm))
+}
+
+// overlayGif returns anim with overlay drawn at r of every frame, through
+// mask if not nil. The overlay is mapped to the palette of each frame and
+// only drawn within the bounds of the frame.
+func overlayGif(anim *gif.GIF, overlay image.Image, r image.Rectangle, mask image.Image) *gif.GIF {
+	out := *anim
+	out.Image = make([]*image.Paletted, len(anim.Image))
+	for i, frame := range anim.Image {
+		dst := image.NewPaletted(frame.Rect, frame.Palette)
+		for y := 0; y < frame.Rect.Dy(); y++ {
+			copy(dst.Pix[y*dst.Stride:(y+1)*dst.Stride], frame.Pix[y*frame.Stride:])
+		}
+		draw.DrawMask(dst, r, overlay, overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+		out.Image[i] = dst
+	}
+	return &out
+}
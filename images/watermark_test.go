@@ -0,0 +1,104 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+func Test_watermarkRect(t *testing.T) {
+	t.Parallel()
+	bounds := image.Rect(0, 0, 200, 100)
+	tests := []struct {
+		name string
+		size image.Point
+		wm   Watermark
+		want image.Rectangle
+	}{
+		{"default southeast", image.Pt(20, 10), Watermark{}, image.Rect(180, 90, 200, 100)},
+		{"northwest margin", image.Pt(20, 10), Watermark{Gravity: GravityNorthWest, Margin: 5}, image.Rect(5, 5, 25, 15)},
+		{"center", image.Pt(20, 10), Watermark{Gravity: GravityCenter}, image.Rect(90, 45, 110, 55)},
+		{"south", image.Pt(20, 10), Watermark{Gravity: GravitySouth, Margin: 2}, image.Rect(90, 88, 110, 98)},
+		{"east", image.Pt(20, 10), Watermark{Gravity: GravityEast}, image.Rect(180, 45, 200, 55)},
+		{"scaled", image.Pt(20, 10), Watermark{Gravity: GravityNorthWest, Scale: 0.5}, image.Rect(0, 0, 100, 50)},
+		{"too large", image.Pt(400, 100), Watermark{Gravity: GravityNorthWest, Margin: 10}, image.Rect(10, 10, 190, 55)},
+		{"margin too large", image.Pt(20, 10), Watermark{Gravity: GravityNorthWest, Margin: 60}, image.Rect(49, 49, 53, 51)},
+		{"margin too large southeast", image.Pt(20, 10), Watermark{Margin: 500}, image.Rect(147, 49, 151, 51)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := watermarkRect(bounds, tt.size, tt.wm); got != tt.want {
+				t.Errorf("watermarkRect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatermark_Validate(t *testing.T) {
+	t.Parallel()
+	valid := []Watermark{{Path: "wm.png"}, {Path: "wm.png", Gravity: GravityNorth, Margin: 10, Opacity: 0.5, Scale: 1}}
+	for _, wm := range valid {
+		if err := wm.Validate(); err != nil {
+			t.Errorf("Watermark%+v.Validate() error = %v", wm, err)
+		}
+	}
+	invalid := []Watermark{{Gravity: "up"}, {Margin: -1}, {Opacity: 1.5}, {Scale: 2}}
+	for _, wm := range invalid {
+		if err := wm.Validate(); err == nil {
+			t.Errorf("Watermark%+v.Validate() expected an error", wm)
+		}
+	}
+}
+
+func Test_applyWatermark(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+	mark := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(mark, mark.Rect, image.Black, image.Point{}, draw.Src)
+
+	got := applyWatermark(img, mark, Watermark{Path: "wm", Margin: 1}, NearestNeighbor)
+	if c := color.GrayModel.Convert(got.At(37, 17)).(color.Gray); c.Y != 0 {
+		t.Errorf("applyWatermark() at (37, 17) = %v, want black", c)
+	}
+	if c := color.GrayModel.Convert(got.At(39, 19)).(color.Gray); c.Y != 255 {
+		t.Errorf("applyWatermark() at the margin = %v, want white", c)
+	}
+	// the input is left untouched
+	if c := color.GrayModel.Convert(img.At(37, 17)).(color.Gray); c.Y != 255 {
+		t.Errorf("applyWatermark() changed the input to %v", c)
+	}
+
+	got = applyWatermark(img, mark, Watermark{Path: "wm", Opacity: 0.5}, NearestNeighbor)
+	if c := color.GrayModel.Convert(got.At(38, 18)).(color.Gray); c.Y < 120 || c.Y > 135 {
+		t.Errorf("applyWatermark() with half opacity = %v, want gray", c)
+	}
+}
+
+func Test_watermarkGif(t *testing.T) {
+	t.Parallel()
+	palette := color.Palette{color.White, color.Black}
+	anim := &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 20, 10), palette), image.NewPaletted(image.Rect(0, 0, 5, 5), palette)},
+		Delay:  []int{1, 2},
+		Config: image.Config{Width: 20, Height: 10},
+	}
+	mark := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(mark, mark.Rect, image.Black, image.Point{}, draw.Src)
+
+	got := watermarkGif(anim, mark, Watermark{Path: "wm"}, NearestNeighbor)
+	if len(got.Image) != 2 || got.Delay[1] != 2 {
+		t.Fatalf("watermarkGif() changed the animation: %+v", got)
+	}
+	if i := got.Image[0].ColorIndexAt(18, 8); i != 1 {
+		t.Errorf("watermarkGif() index at (18, 8) = %d, want 1", i)
+	}
+	if got.Image[1].Rect != anim.Image[1].Rect {
+		t.Errorf("watermarkGif() frame bounds = %v, want %v", got.Image[1].Rect, anim.Image[1].Rect)
+	}
+	if i := anim.Image[0].ColorIndexAt(18, 8); i != 0 {
+		t.Errorf("watermarkGif() changed the input")
+	}
+}
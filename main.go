@@ -116,6 +116,9 @@ func run() error {
 
 		images.WithCreateDirs(conf.Files.CreateDirs),
 		images.WithSetPermissions(conf.Files.SetPerms),
+		images.WithBakeOrientation(conf.Files.BakeOrientation),
+		images.WithScrubGps(conf.Files.ScrubGps),
+		images.WithDedupe(conf.Files.Dedupe),
 
 		images.WithOriginalsDir(conf.Files.DirOriginals),
 		images.WithCacheDir(conf.Files.DirCache),
@@ -287,7 +290,9 @@ func addFolder(ih *images.ImageHandler, folder string) error {
 		}
 		defer file.Close()
 		id, err := ih.Add(file)
-		if err != nil {
+		if errors.Is(err, images.ErrDuplicate{}) {
+			log.Default().Debug("image already added", "file", file.Name(), "id", id)
+		} else if err != nil {
 			log.Default().Warn("failed to add image", "file", info.Name(), "error", err)
 		} else {
 			log.Default().Debug("added image", "file", file.Name(), "id", id)
@@ -76,7 +76,15 @@ func (srv *server) routes() {
 	// API
 	srv.router.HandleFunc("GET", "/api/images", srv.handleApiImageGet())
 	srv.router.HandleFunc("POST", "/api/images", srv.handleApiImagePost())
+	srv.router.HandleFunc("GET", "/api/images/:id", srv.handleApiImageInfo())
 	srv.router.HandleFunc("DELETE", "/api/images/:id", srv.handleApiImageDelete())
+	srv.router.HandleFunc("GET", "/api/images/:id/focus", srv.handleApiImageFocus())
+	srv.router.HandleFunc("PUT", "/api/images/:id/focus", srv.handleApiImageFocus())
+	srv.router.HandleFunc("GET", "/api/images/:id/placeholder", srv.handleApiImagePlaceholder())
+	srv.router.HandleFunc("GET", "/api/images/:id/colors", srv.handleApiImageColors())
+	srv.router.HandleFunc("GET", "/api/images/:id/similar", srv.handleApiImageSimilar())
+	srv.router.HandleFunc("GET", "/api/images/:id/srcset", srv.handleApiImageSrcset())
+	srv.router.HandleFunc("GET", "/api/sheets", srv.handleApiSheet())
 	srv.router.HandleFunc("*", "/api/", srv.handleNotAllowed())
 
 	// Admin
@@ -451,6 +459,10 @@ func (srv *server) respondError(w http.ResponseWriter, r *http.Request, msg stri
 //  HELPERS
 
 func (srv *server) respondWithImage(w http.ResponseWriter, r *http.Request, l *log.Logger, imgPar images.ImageParameters) {
+	if imgPar.Format == images.Auto {
+		imgPar.Format = negotiateFormat(r.Header.Get("Accept"), srv.ih.DefaultFormat())
+		w.Header().Add("Vary", "Accept")
+	}
 	path, err := srv.ih.Get(imgPar)
 	if err != nil {
 		if errors.Is(err, images.ErrIdNotFound{}) {
@@ -458,6 +470,21 @@ func (srv *server) respondWithImage(w http.ResponseWriter, r *http.Request, l *l
 			srv.respondError(w, r, fmt.Sprintf("id '%d' was not found", imgPar.Id), http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, images.ErrInvalidCrop{}) {
+			l.Warn("invalid crop", "id", imgPar.Id, "crop", imgPar.Crop, "err", err)
+			srv.respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, images.ErrInvalidFrame{}) {
+			l.Warn("invalid frame", "id", imgPar.Id, "frame", imgPar.Frame, "err", err)
+			srv.respondError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, images.ErrMaxSize{}) {
+			l.Warn("could not meet max size", "id", imgPar.Id, "ImageParameters", imgPar, "err", err)
+			srv.respondError(w, r, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		l.Error("failed to serve image", "id", imgPar.Id, "ImageParameters", imgPar, "err", err)
 		srv.respondError(w, r, err.Error(), http.StatusInternalServerError)
 		return
@@ -467,8 +494,81 @@ func (srv *server) respondWithImage(w http.ResponseWriter, r *http.Request, l *l
 	srv.Stats.ImagesServed++
 }
 
+// negotiateFormat picks an image format from the Accept header of a request.
+// Webp is only picked when listed explicitly, as clients that can not decode
+// it send wildcards as well. Otherwise fallback is preferred, then jpeg, png
+// and gif. fallback is returned if nothing acceptable is found.
+func negotiateFormat(accept string, fallback images.Format) images.Format {
+	if accept == "" {
+		return fallback
+	}
+
+	explicit := map[string]float64{}
+	wildcard := false
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if mediaType == "*/*" || mediaType == "image/*" {
+			wildcard = wildcard || q > 0
+			continue
+		}
+		explicit[mediaType] = q
+	}
+
+	acceptable := func(f images.Format) bool {
+		mediaType := "image/" + f.String()
+		if f == images.Png8 {
+			mediaType = "image/png"
+		}
+		if q, ok := explicit[mediaType]; ok {
+			return q > 0
+		}
+		return wildcard && f != images.Webp
+	}
+	for _, f := range []images.Format{images.Webp, fallback, images.Jpeg, images.Png, images.Gif} {
+		if acceptable(f) {
+			return f
+		}
+	}
+	return fallback
+}
+
 func parseImageParameters(id int, val url.Values) (images.ImageParameters, error) {
-	p := images.ImageParameters{Id: id}
+	return parseImageParametersWithPreset(id, val, images.ImagePreset{})
+}
+
+func parseImageParametersWithPreset(id int, val url.Values, pre images.ImagePreset) (images.ImageParameters, error) {
+	p := images.ImageParameters{
+		Id:      id,
+		Width:   uint(pre.Width),
+		Height:  uint(pre.Height),
+		Quality: pre.Quality,
+		Format:  pre.Format,
+		MaxSize: pre.MaxSize,
+
+		Lossless:      pre.Lossless,
+		Interpolation: pre.Interpolation,
+		Metadata:      pre.Metadata,
+		Fit:           pre.Fit,
+		Background:    pre.Background,
+		BackgroundSet: pre.BackgroundSet,
+		Dither:        pre.Dither,
+		Rotate:        pre.Rotate,
+		Flip:          pre.Flip,
+		Filters:       pre.Filters,
+		Watermark:     pre.Watermark,
+		Caption:       pre.Caption,
+
+		DominantBackground: pre.DominantBackground,
+	}
 	errs := []error{}
 
 	if val.Has("width") {
@@ -542,50 +642,236 @@ func parseImageParameters(id int, val url.Values) (images.ImageParameters, error
 		}
 	}
 
-	err := errors.Join(errs...)
-	return p, err
-}
+	if val.Has("lossless") {
+		if v, err := strconv.ParseBool(val.Get("lossless")); err == nil {
+			p.Lossless = v
+		} else {
+			errs = append(errs, err)
+		}
+	} else if val.Has("ll") {
+		if v, err := strconv.ParseBool(val.Get("ll")); err == nil {
+			p.Lossless = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
 
-func parseImageParametersWithPreset(id int, val url.Values, pre images.ImagePreset) (images.ImageParameters, error) {
-	p := images.ImageParameters{
-		Id:      id,
-		Width:   uint(pre.Width),
-		Height:  uint(pre.Height),
-		Quality: pre.Quality,
-		Format:  pre.Format,
-		MaxSize: pre.MaxSize,
+	if val.Has("interpolation") {
+		if v, err := images.ParseInterpolation(val.Get("interpolation")); err == nil {
+			p.Interpolation = v
+		} else {
+			errs = append(errs, err)
+		}
+	} else if val.Has("i") {
+		if v, err := images.ParseInterpolation(val.Get("i")); err == nil {
+			p.Interpolation = v
+		} else {
+			errs = append(errs, err)
+		}
 	}
-	errs := []error{}
 
-	if val.Has("width") {
-		if v, err := strconv.ParseUint(val.Get("width"), 10, 32); err == nil {
-			p.Width = uint(v)
+	if val.Has("frame") {
+		if v, err := strconv.ParseUint(val.Get("frame"), 10, 32); err == nil {
+			p.Frame = uint(v)
 		} else {
 			errs = append(errs, err)
 		}
-	} else if val.Has("w") {
-		if v, err := strconv.ParseUint(val.Get("w"), 10, 32); err == nil {
-			p.Width = uint(v)
+	} else if val.Has("fr") {
+		if v, err := strconv.ParseUint(val.Get("fr"), 10, 32); err == nil {
+			p.Frame = uint(v)
 		} else {
 			errs = append(errs, err)
 		}
+	}
 
+	if val.Has("fit") {
+		if v, err := images.ParseFit(val.Get("fit")); err == nil {
+			p.Fit = v
+		} else {
+			errs = append(errs, err)
+		}
 	}
 
-	if val.Has("height") {
-		if v, err := strconv.ParseUint(val.Get("height"), 10, 32); err == nil {
-			p.Height = uint(v)
+	if val.Has("dither") {
+		if v, err := images.ParseDither(val.Get("dither")); err == nil {
+			p.Dither = v
 		} else {
 			errs = append(errs, err)
 		}
-	} else if val.Has("h") {
-		if v, err := strconv.ParseUint(val.Get("h"), 10, 32); err == nil {
-			p.Height = uint(v)
+	}
+
+	if val.Has("background") {
+		if err := parseBackground(&p, val.Get("background")); err != nil {
+			errs = append(errs, err)
+		}
+	} else if val.Has("bg") {
+		if err := parseBackground(&p, val.Get("bg")); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("crop") {
+		if v, err := images.ParseCrop(val.Get("crop")); err == nil {
+			p.Crop = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("rotate") {
+		if v, err := images.ParseRotation(val.Get("rotate")); err == nil {
+			p.Rotate = v
+		} else {
+			errs = append(errs, err)
+		}
+	} else if val.Has("rot") {
+		if v, err := images.ParseRotation(val.Get("rot")); err == nil {
+			p.Rotate = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("flip") {
+		if v, err := images.ParseFlip(val.Get("flip")); err == nil {
+			p.Flip = v
 		} else {
 			errs = append(errs, err)
 		}
 	}
 
+	if val.Has("grayscale") {
+		if v, err := strconv.ParseBool(val.Get("grayscale")); err == nil {
+			p.Filters.Grayscale = v
+		} else {
+			errs = append(errs, err)
+		}
+	} else if val.Has("gray") {
+		if v, err := strconv.ParseBool(val.Get("gray")); err == nil {
+			p.Filters.Grayscale = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	filters := []struct {
+		long, short string
+		v           *float64
+	}{
+		{"brightness", "bri", &p.Filters.Brightness},
+		{"contrast", "con", &p.Filters.Contrast},
+		{"saturation", "sat", &p.Filters.Saturation},
+		{"blur", "bl", &p.Filters.Blur},
+		{"sharpen", "sh", &p.Filters.Sharpen},
+	}
+	for _, f := range filters {
+		key := f.long
+		if !val.Has(key) {
+			key = f.short
+		}
+		if !val.Has(key) {
+			continue
+		}
+		if v, err := strconv.ParseFloat(val.Get(key), 64); err == nil {
+			*f.v = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	if err := p.Filters.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// a watermark can only be removed, unless the preset locks it
+	if val.Has("watermark") {
+		if v, err := strconv.ParseBool(val.Get("watermark")); err == nil {
+			if !v && !p.Watermark.Locked {
+				p.Watermark = images.Watermark{}
+			}
+		} else {
+			errs = append(errs, err)
+		}
+	} else if val.Has("wm") {
+		if v, err := strconv.ParseBool(val.Get("wm")); err == nil {
+			if !v && !p.Watermark.Locked {
+				p.Watermark = images.Watermark{}
+			}
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("dpr") {
+		if v, err := images.ParseDpr(val.Get("dpr")); err == nil {
+			p.Dpr = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	// only presets that allow it take a text through the url
+	if val.Has("text") {
+		if err := p.Caption.SetText(val.Get("text")); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err := errors.Join(errs...)
+	return p, err
+}
+
+// parseBackground sets the background of p to a hex color or to the
+// dominant color of the image.
+func parseBackground(p *images.ImageParameters, str string) error {
+	if str == images.BackgroundDominant {
+		p.DominantBackground = true
+		return nil
+	}
+	v, err := images.ParseColor(str)
+	if err != nil {
+		return err
+	}
+	p.Background = v
+	p.BackgroundSet = true
+	p.DominantBackground = false
+	return nil
+}
+
+// parseSheetParameters parses the query of a sheet request, e.g.
+// "ids=1,2,3&cols=4&cell=200x200&f=jpeg".
+func parseSheetParameters(val url.Values) (images.SheetParameters, error) {
+	p := images.SheetParameters{}
+	errs := []error{}
+
+	if val.Has("ids") {
+		for _, str := range strings.Split(val.Get("ids"), ",") {
+			if v, err := strconv.Atoi(strings.TrimSpace(str)); err == nil {
+				p.Ids = append(p.Ids, v)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if val.Has("cols") {
+		if v, err := strconv.ParseUint(val.Get("cols"), 10, 32); err == nil {
+			p.Cols = int(v)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("cell") {
+		w, h, ok := strings.Cut(val.Get("cell"), "x")
+		width, errW := strconv.ParseUint(w, 10, 32)
+		height, errH := strconv.ParseUint(h, 10, 32)
+		if ok && errW == nil && errH == nil {
+			p.CellWidth, p.CellHeight = uint(width), uint(height)
+		} else {
+			errs = append(errs, fmt.Errorf("invalid cell size. \n\tGot: '%s'\n\tWant: width x height in pixels, e.g. '200x200'", val.Get("cell")))
+		}
+	}
+
 	if val.Has("quality") {
 		if v, err := strconv.Atoi(val.Get("quality")); err == nil {
 			p.Quality = v
@@ -614,15 +900,37 @@ func parseImageParametersWithPreset(id int, val url.Values, pre images.ImagePres
 		}
 	}
 
-	if val.Has("maxsize") {
-		if v, err := size.Parse(val.Get("maxsize")); err == nil {
-			p.MaxSize = v
+	if val.Has("interpolation") {
+		if v, err := images.ParseInterpolation(val.Get("interpolation")); err == nil {
+			p.Interpolation = v
 		} else {
 			errs = append(errs, err)
 		}
-	} else if val.Has("s") {
-		if v, err := size.Parse(val.Get("s")); err == nil {
-			p.MaxSize = v
+	} else if val.Has("i") {
+		if v, err := images.ParseInterpolation(val.Get("i")); err == nil {
+			p.Interpolation = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("fit") {
+		if v, err := images.ParseFit(val.Get("fit")); err == nil {
+			p.Fit = v
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if val.Has("background") {
+		if v, err := images.ParseColor(val.Get("background")); err == nil {
+			p.Background, p.BackgroundSet = v, true
+		} else {
+			errs = append(errs, err)
+		}
+	} else if val.Has("bg") {
+		if v, err := images.ParseColor(val.Get("bg")); err == nil {
+			p.Background, p.BackgroundSet = v, true
 		} else {
 			errs = append(errs, err)
 		}
@@ -643,10 +951,16 @@ func parseImageFormat(str string) (images.Format, error) {
 		return images.Jpeg, nil
 	case "PNG":
 		return images.Png, nil
+	case "PNG8":
+		return images.Png8, nil
 	case "GIF":
 		return images.Gif, nil
+	case "WEBP":
+		return images.Webp, nil
+	case "AUTO":
+		return images.Auto, nil
 	default:
-		return images.Jpeg, fmt.Errorf("could not parse image format: %s\n(supported formats are: jpg (/jpeg), png and gif)", str)
+		return images.Jpeg, fmt.Errorf("could not parse image format: %s\n(supported formats are: jpg (/jpeg), png, png8, gif, webp and auto)", str)
 	}
 }
 
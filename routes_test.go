@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -93,6 +100,541 @@ func Test_HandleImg(t *testing.T) {
 	}
 }
 
+func Test_HandleImg_auto(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg")
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"image/avif,image/webp,*/*;q=0.8", "image/webp"},
+		{"*/*", "image/jpeg"},
+		{"image/png", "image/png"},
+		{"image/webp;q=0,image/*", "image/jpeg"},
+	}
+	for _, tt := range tests {
+		// act
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/"+strconv.Itoa(id)+"?w=50&f=auto", nil)
+		req.Header.Set("Accept", tt.accept)
+		srv.ServeHTTP(w, req)
+
+		// assert
+		is.Equal(w.Result().StatusCode, http.StatusOK)
+		is.Equal(w.Result().Header.Get("Content-Type"), tt.want) // Accept: tt.accept
+		is.Equal(w.Result().Header.Get("Vary"), "Accept")
+	}
+}
+
+func Test_HandleImgWithPreset_text(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{
+		presets: []images.ImagePreset{
+			{Name: "sample", Alias: []string{"sample"}, Width: 100, Caption: images.Caption{Text: "SAMPLE", MaxLength: 10}},
+		},
+	})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg")
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/"+strconv.Itoa(id)+"/sample/?text=Jo", nil))
+	is.Equal(w.Code, http.StatusOK)
+
+	// an empty text would serve the image without its caption
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/"+strconv.Itoa(id)+"/sample/?text=", nil))
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func Test_HandleApiImageFocus(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg")
+	path := "/api/images/" + strconv.Itoa(id) + "/focus"
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("PUT", path, strings.NewReader(`{"x": 0.25, "y": 0.1}`)))
+	is.Equal(w.Code, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `"x":0.25`))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("PUT", path, strings.NewReader(`{"x": 2, "y": 0}`)))
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("PUT", "/api/images/9999/focus", strings.NewReader(`{"x": 0, "y": 0}`)))
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func Test_HandleApiImagePlaceholder(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+
+	// act & assert: upload
+	w := uploadImage(t, srv, test_import_source+"/one.jpg")
+	is.Equal(w.Code, http.StatusCreated)
+
+	uploaded := struct {
+		Id          int
+		Placeholder images.Placeholder
+	}{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&uploaded))
+	is.True(uploaded.Placeholder.BlurHash != "")
+	is.True(strings.HasPrefix(uploaded.Placeholder.DataUri, "data:image/jpeg;base64,"))
+
+	// act & assert: placeholder
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/"+strconv.Itoa(uploaded.Id)+"/placeholder", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got := struct {
+		Id          int
+		Placeholder images.Placeholder
+	}{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got, uploaded)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/9999/placeholder", nil))
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func Test_HandleApiImagePost_duplicate(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{dedupe: true})
+	upload := func() (int, int, bool) {
+		w := uploadImage(t, srv, test_import_source+"/one.jpg")
+		got := struct {
+			Id        int
+			Duplicate bool
+		}{}
+		is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+		return w.Code, got.Id, got.Duplicate
+	}
+
+	// act & assert
+	code, id, duplicate := upload()
+	is.Equal(code, http.StatusCreated)
+	is.True(!duplicate)
+
+	code, dupId, duplicate := upload()
+	is.Equal(code, http.StatusOK)
+	is.True(duplicate)
+	is.Equal(dupId, id)
+}
+
+func Test_HandleApiImageColors(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg")
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/"+strconv.Itoa(id)+"/colors?n=3", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got := struct {
+		Id     int
+		Colors images.Colors
+	}{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got.Id, id)
+	is.True(len(got.Colors.Palette) > 0 && len(got.Colors.Palette) <= 3)
+	is.Equal(got.Colors.Dominant, got.Colors.Palette[0].Color)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/"+strconv.Itoa(id)+"/colors?n=17", nil))
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/9999/colors", nil))
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func Test_HandleApiImageSimilar(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg")
+	path, err := srv.ih.Get(images.ImageParameters{Id: id, Width: 200})
+	is.NoErr(err)
+	copyId := addOrig(t, srv.ih, path)
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/"+strconv.Itoa(id)+"/similar?max_distance=12", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got := struct {
+		Id      int
+		Similar []images.Similar
+	}{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got.Id, id)
+	is.Equal(len(got.Similar), 1)
+	is.Equal(got.Similar[0].Id, copyId)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/"+strconv.Itoa(id)+"/similar?max_distance=65", nil))
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/9999/similar", nil))
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func Test_HandleApiImageSrcset(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{
+		presets: []images.ImagePreset{
+			{Name: "square", Alias: []string{"sq"}, Format: images.Webp, Width: 200, Height: 200, Fit: images.FitCover},
+		},
+	})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg") // 3872x2592
+	prefix := "/api/images/" + strconv.Itoa(id) + "/srcset"
+	type source struct {
+		Type   string
+		Srcset string
+		Urls   []struct {
+			Width int
+			Url   string
+		}
+	}
+	type response struct {
+		Id          int
+		Width       int
+		Height      int
+		Sources     []source
+		Fallback    source
+		Img         string
+		Picture     string
+		Placeholder *images.Placeholder
+	}
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", prefix+"?widths=640,320,320&alt=a%22b", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got := response{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got.Id, id)
+	is.Equal(got.Width, 640)
+	is.Equal(got.Height, 428)
+	is.Equal(got.Fallback.Type, "image/jpeg")
+	is.Equal(len(got.Fallback.Urls), 2)
+	is.Equal(got.Fallback.Urls[0].Url, "/"+strconv.Itoa(id)+"/?f=jpeg&w=320")
+	is.Equal(got.Fallback.Srcset, "/"+strconv.Itoa(id)+"/?f=jpeg&w=320 320w, /"+strconv.Itoa(id)+"/?f=jpeg&w=640 640w")
+	is.Equal(len(got.Sources), 1)
+	is.Equal(got.Sources[0].Type, "image/webp")
+	is.True(strings.Contains(got.Img, `alt="a&#34;b"`))
+	is.True(strings.Contains(got.Img, `width="640" height="428"`))
+	is.True(strings.Contains(got.Picture, `<source type="image/webp"`))
+	is.Equal(got.Placeholder, nil)
+
+	// every url serves an image
+	for _, u := range append(got.Fallback.Urls, got.Sources[0].Urls...) {
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", u.Url, nil))
+		is.Equal(w.Code, http.StatusOK)
+	}
+
+	// widths are capped at the original
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", prefix+"?widths=2000,5000", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got = response{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got.Width, 3872)
+	is.Equal(len(got.Fallback.Urls), 2)
+
+	// presets keep their ratio and fall back from webp
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", prefix+"?preset=sq&widths=320&placeholder=true", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got = response{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got.Height, 320)
+	// aliases give the urls of the preset name
+	is.Equal(got.Fallback.Urls[0].Url, "/"+strconv.Itoa(id)+"/square/?f=jpeg&h=320&w=320")
+	_, ok := srv.ih.GetPreset("square")
+	is.True(ok)
+	is.True(got.Placeholder != nil)
+	is.True(strings.Contains(got.Img, "background-image: url(data:image/"))
+
+	for _, query := range []string{"?preset=nope", "?widths=0", "?widths=a,b", "?placeholder=maybe"} {
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", prefix+query, nil))
+		is.Equal(w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/9999/srcset", nil))
+	is.Equal(w.Code, http.StatusNotFound)
+
+	// widths are capped at the largest size served
+	capped := srcsetOptions{id: id, defaultFormat: images.Jpeg, maxDimension: 1000, info: images.Info{Width: 3872, Height: 2592}, widths: []int{640, 4000}}
+	set := buildSrcset(capped)
+	is.Equal(set.Width, 1000)
+	is.Equal(len(set.Fallback.Urls), 2)
+	capped.preset = images.ImagePreset{Width: 100, Height: 200}
+	set = buildSrcset(capped)
+	is.Equal(set.Width, 500)
+	is.Equal(set.Height, 1000)
+}
+
+func Test_HandleApiImageInfo(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+	id := addOrig(t, srv.ih, test_import_source+"/one.jpg")
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/"+strconv.Itoa(id), nil))
+	is.Equal(w.Code, http.StatusOK)
+	got := map[string]any{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got["id"], float64(id))
+	is.Equal(got["width"], float64(3872))
+	is.Equal(got["height"], float64(2592))
+	is.Equal(got["format"], "jpeg")
+	is.Equal(got["frames"], float64(1))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/images/9999", nil))
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func Test_parseSheetParameters(t *testing.T) {
+	is := is.New(t)
+
+	p, err := parseSheetParameters(url.Values{"ids": {"1,2, 3"}, "cols": {"4"}, "cell": {"200x150"}, "f": {"webp"}, "fit": {"contain"}, "bg": {"000"}})
+	is.NoErr(err)
+	is.Equal(p.Ids, []int{1, 2, 3})
+	is.Equal(p.Cols, 4)
+	is.Equal(p.CellWidth, uint(200))
+	is.Equal(p.CellHeight, uint(150))
+	is.Equal(p.Format, images.Webp)
+	is.Equal(p.Fit, images.FitContain)
+	is.Equal(p.Background, color.NRGBA{0, 0, 0, 255})
+
+	_, err = parseSheetParameters(url.Values{"ids": {"1,a"}})
+	is.True(err != nil)
+
+	_, err = parseSheetParameters(url.Values{"cell": {"200"}})
+	is.True(err != nil)
+}
+
+func Test_HandleApiSheet(t *testing.T) {
+	is := is.New(t)
+
+	// arrange
+	srv := newTestServer(t, testServerOptions{})
+	ids := []string{}
+	for _, name := range []string{"one.jpg", "two.jpg"} {
+		ids = append(ids, strconv.Itoa(addOrig(t, srv.ih, test_import_source+"/"+name)))
+	}
+	query := "/api/sheets?ids=" + strings.Join(ids, ",") + "&cols=1&cell=100x80&f=png"
+
+	// act & assert
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Header().Get("Content-Type"), "image/png")
+	conf, err := png.DecodeConfig(w.Body)
+	is.NoErr(err)
+	is.Equal(conf.Width, 100)
+	is.Equal(conf.Height, 160)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", query+"&map=true", nil))
+	is.Equal(w.Code, http.StatusOK)
+	got := struct {
+		Url    string
+		Width  int
+		Height int
+		Cells  []images.SheetCell
+	}{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got.Width, 100)
+	is.Equal(got.Height, 160)
+	is.Equal(len(got.Cells), 2)
+	is.Equal(got.Cells[1].Y, 80)
+	is.True(!strings.Contains(got.Url, "map"))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/sheets?ids=1,9999&cell=100x100", nil))
+	is.Equal(w.Code, http.StatusNotFound)
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/sheets?ids=1", nil))
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func Test_negotiateFormat(t *testing.T) {
+	is := is.New(t)
+	is.Equal(negotiateFormat("", images.Png), images.Png)
+	is.Equal(negotiateFormat("image/webp,image/*;q=0.8", images.Jpeg), images.Webp)
+	is.Equal(negotiateFormat("text/html, image/gif", images.Jpeg), images.Gif)
+	is.Equal(negotiateFormat("image/*", images.Webp), images.Jpeg)
+	is.Equal(negotiateFormat("text/html", images.Jpeg), images.Jpeg)
+	is.Equal(negotiateFormat("image/png", images.Png8), images.Png8)
+}
+
+func Test_parseImageParametersWithPreset(t *testing.T) {
+	is := is.New(t)
+
+	preset := images.ImagePreset{
+		Name:          "pixel art",
+		Format:        images.Png,
+		Width:         64,
+		Height:        64,
+		Interpolation: images.NearestNeighbor,
+	}
+
+	// preset values are used when not overridden
+	p, err := parseImageParametersWithPreset(1, url.Values{}, preset)
+	is.NoErr(err)
+	is.Equal(p.Interpolation, images.NearestNeighbor)
+	is.Equal(p.Width, uint(64))
+
+	// query overrides preset
+	p, err = parseImageParametersWithPreset(1, url.Values{"i": {"bilinear"}}, preset)
+	is.NoErr(err)
+	is.Equal(p.Interpolation, images.Bilinear)
+
+	p, err = parseImageParameters(1, url.Values{"interpolation": {"lanczos2"}, "w": {"10"}})
+	is.NoErr(err)
+	is.Equal(p.Interpolation, images.Lanczos2)
+	is.Equal(p.Width, uint(10))
+
+	_, err = parseImageParameters(1, url.Values{"i": {"sharpest"}})
+	is.True(err != nil)
+
+	p, err = parseImageParameters(1, url.Values{"frame": {"2"}, "f": {"png"}})
+	is.NoErr(err)
+	is.Equal(p.Frame, uint(2))
+
+	p, err = parseImageParameters(1, url.Values{"f": {"png8"}, "q": {"64"}})
+	is.NoErr(err)
+	is.Equal(p.Format, images.Png8)
+	is.Equal(p.Quality, 64)
+
+	p, err = parseImageParameters(1, url.Values{"f": {"gif"}, "dither": {"ordered"}})
+	is.NoErr(err)
+	is.Equal(p.Dither, images.DitherOrdered)
+
+	_, err = parseImageParameters(1, url.Values{"dither": {"bayer"}})
+	is.True(err != nil)
+
+	_, err = parseImageParameters(1, url.Values{"fr": {"-1"}})
+	is.True(err != nil)
+	p, err = parseImageParameters(1, url.Values{"fit": {"contain"}, "bg": {"000"}})
+	is.NoErr(err)
+	is.Equal(p.Fit, images.FitContain)
+	is.Equal(p.Background, color.NRGBA{0, 0, 0, 255})
+
+	p, err = parseImageParameters(1, url.Values{"fit": {"contain"}, "bg": {"00000000"}})
+	is.NoErr(err)
+	is.Equal(p.Background, color.NRGBA{})
+	is.True(p.BackgroundSet)
+
+	p, err = parseImageParameters(1, url.Values{"fit": {"contain"}, "bg": {"dominant"}})
+	is.NoErr(err)
+	is.True(p.DominantBackground)
+
+	_, err = parseImageParameters(1, url.Values{"fit": {"stretch"}})
+	is.True(err != nil)
+
+	p, err = parseImageParameters(1, url.Values{"crop": {"10,20,300,200"}})
+	is.NoErr(err)
+	is.Equal(p.Crop, images.Crop{X: 10, Y: 20, W: 300, H: 200})
+
+	p, err = parseImageParameters(1, url.Values{"crop": {"0%,0%,50%,50%"}})
+	is.NoErr(err)
+	is.Equal(p.Crop, images.Crop{W: 50, H: 50, Percent: true})
+
+	_, err = parseImageParameters(1, url.Values{"crop": {"10,20"}})
+	is.True(err != nil)
+
+	p, err = parseImageParameters(1, url.Values{"rot": {"90"}, "flip": {"hv"}})
+	is.NoErr(err)
+	is.Equal(p.Rotate, images.Rotate90)
+	is.Equal(p.Flip, images.FlipHV)
+
+	_, err = parseImageParameters(1, url.Values{"rotate": {"45"}})
+	is.True(err != nil)
+
+	_, err = parseImageParameters(1, url.Values{"flip": {"x"}})
+	is.True(err != nil)
+
+	p, err = parseImageParameters(1, url.Values{"gray": {"true"}, "blur": {"4"}, "sh": {"0.5"}, "brightness": {"-20"}, "con": {"10"}, "sat": {"50"}})
+	is.NoErr(err)
+	is.Equal(p.Filters, images.Filters{Grayscale: true, Blur: 4, Sharpen: 0.5, Brightness: -20, Contrast: 10, Saturation: 50})
+
+	_, err = parseImageParameters(1, url.Values{"blur": {"1000"}})
+	is.True(err != nil)
+
+	_, err = parseImageParameters(1, url.Values{"sat": {"much"}})
+	is.True(err != nil)
+
+	preview := images.ImagePreset{Width: 100, Watermark: images.Watermark{Path: "wm.png"}}
+	p, err = parseImageParametersWithPreset(1, url.Values{}, preview)
+	is.NoErr(err)
+	is.Equal(p.Watermark, preview.Watermark)
+
+	p, err = parseImageParametersWithPreset(1, url.Values{"wm": {"false"}}, preview)
+	is.NoErr(err)
+	is.True(p.Watermark.IsZero())
+
+	p, err = parseImageParametersWithPreset(1, url.Values{"dpr": {"2"}}, images.ImagePreset{Width: 100})
+	is.NoErr(err)
+	is.Equal(p.Dpr, 2.0)
+	is.Equal(p.Width, uint(100)) // multiplied by the image handler
+
+	_, err = parseImageParameters(1, url.Values{"dpr": {"5"}})
+	is.True(err != nil)
+
+	sample := images.ImagePreset{Width: 100, Caption: images.Caption{Text: "SAMPLE", MaxLength: 10}}
+	p, err = parseImageParametersWithPreset(1, url.Values{"text": {"© Jo"}}, sample)
+	is.NoErr(err)
+	is.Equal(p.Caption.Text, "© Jo")
+
+	_, err = parseImageParametersWithPreset(1, url.Values{"text": {"much too long"}}, sample)
+	is.True(err != nil)
+
+	_, err = parseImageParametersWithPreset(1, url.Values{"text": {""}}, sample)
+	is.True(err != nil)
+
+	_, err = parseImageParameters(1, url.Values{"text": {"hi"}})
+	is.True(err != nil)
+
+	preview.Watermark.Locked = true
+	p, err = parseImageParametersWithPreset(1, url.Values{"watermark": {"false"}}, preview)
+	is.NoErr(err)
+	is.Equal(p.Watermark, preview.Watermark)
+}
+
 // BENCHMARKS
 
 func Benchmark_HandleImg_cached(b *testing.B) {
@@ -288,3 +830,76 @@ func addOrigB(b *testing.B, ih *images.ImageHandler, path string) int {
 	}
 	return id
 }
+
+// testServerOptions configures the image handler of newTestServer. The zero
+// value uses the defaults of images.New.
+type testServerOptions struct {
+	presets []images.ImagePreset
+	dedupe  bool
+}
+
+// newTestServer returns a server with its routes set up. Its image handler
+// keeps originals and cache in temporary directories, which are removed when
+// the test ends.
+func newTestServer(t *testing.T, opts testServerOptions) *server {
+	t.Helper()
+	originalsDir, err := os.MkdirTemp(testFsDir, "testServer-Originals_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(originalsDir) })
+
+	cachePath, err := os.MkdirTemp(testFsDir, "testServer-Cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(cachePath) })
+
+	ih, err := images.New(
+		images.WithOriginalsDir(originalsDir),
+		images.WithCacheDir(cachePath),
+		images.WithSetPermissions(true),
+		images.WithCreateDirs(true),
+		images.WithDedupe(opts.dedupe),
+		images.WithImagePresets(opts.presets),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{
+		router:      *way.NewRouter(),
+		ih:          ih,
+		errorLogger: log.New(os.Stderr),
+		conf:        confHttp{MaxUploadSize: "10 MB"},
+	}
+	srv.routes()
+	return srv
+}
+
+// uploadImage posts the file at path to the upload endpoint of srv.
+func uploadImage(t *testing.T, srv *server, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("image", filepath.Base(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = form.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/images", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w
+}
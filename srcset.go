@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/johan-st/go-image-server/images"
+)
+
+// widths used for a srcset when none are requested
+var defaultSrcsetWidths = []int{320, 640, 1280, 1920}
+
+// maxSrcsetWidths is the largest number of widths in a srcset.
+const maxSrcsetWidths = 16
+
+// srcset holds the urls of an image in several widths and formats, and the
+// markup to use them.
+type srcset struct {
+	// intrinsic size of the largest variant
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// alternative formats, best first
+	Sources  []srcsetSource `json:"sources"`
+	Fallback srcsetSource   `json:"fallback"`
+	Img      string         `json:"img"`
+	Picture  string         `json:"picture"`
+}
+
+// srcsetSource is one format of a srcset.
+type srcsetSource struct {
+	Type   string      `json:"type"`
+	Urls   []srcsetUrl `json:"urls"`
+	Srcset string      `json:"srcset"`
+}
+
+type srcsetUrl struct {
+	Width int    `json:"width"`
+	Url   string `json:"url"`
+}
+
+// srcsetOptions is what a srcset is built from.
+type srcsetOptions struct {
+	id int
+	// canonical name of the preset, "" for none
+	presetName string
+	preset     images.ImagePreset
+	// used when neither the preset nor the image decides
+	defaultFormat images.Format
+	// largest width or height the server creates, 0 for no limit
+	maxDimension int
+	info         images.Info
+	widths       []int
+	sizes        string
+	alt          string
+	// data uri shown while the image loads, "" for none
+	placeholder string
+}
+
+// buildSrcset returns the urls and markup for the image described by o.
+// Widths larger than the image are replaced by its width, as they would only
+// scale it up, and widths the server would scale down are replaced by the
+// largest it creates. The urls only differ in width and format, so they are
+// the same for every request and cache well.
+func buildSrcset(o srcsetOptions) srcset {
+	// rotated presets swap the sides of the original
+	ow, oh := o.info.Width, o.info.Height
+	if o.preset.Rotate == images.Rotate90 || o.preset.Rotate == images.Rotate270 {
+		ow, oh = oh, ow
+	}
+	ratio := float64(oh) / float64(ow)
+	fixedRatio := o.preset.Width != 0 && o.preset.Height != 0 && o.preset.Fit != images.FitInside
+	if fixedRatio {
+		ratio = float64(o.preset.Height) / float64(o.preset.Width)
+	}
+	maxWidth := ow
+	if o.maxDimension > 0 {
+		// the height is capped as well when it is part of the url
+		limit := o.maxDimension
+		if fixedRatio && ratio > 1 {
+			limit = int(float64(o.maxDimension) / ratio)
+		}
+		if limit < maxWidth {
+			maxWidth = limit
+		}
+	}
+	widths := srcsetWidths(o.widths, maxWidth)
+
+	query := func(w int, f images.Format) string {
+		q := url.Values{}
+		q.Set("w", strconv.Itoa(w))
+		q.Set("f", f.String())
+		// a height set by the preset is replaced to keep the ratio
+		if fixedRatio {
+			q.Set("h", strconv.Itoa(heightFor(w, ratio)))
+		} else if o.preset.Height != 0 {
+			q.Set("h", "0")
+		}
+		path := fmt.Sprintf("/%d/", o.id)
+		if o.presetName != "" {
+			path = fmt.Sprintf("/%d/%s/", o.id, url.PathEscape(o.presetName))
+		}
+		return path + "?" + q.Encode()
+	}
+	source := func(f images.Format) srcsetSource {
+		s := srcsetSource{Type: mediaType(f)}
+		candidates := make([]string, len(widths))
+		for i, w := range widths {
+			u := query(w, f)
+			s.Urls = append(s.Urls, srcsetUrl{Width: w, Url: u})
+			candidates[i] = fmt.Sprintf("%s %dw", u, w)
+		}
+		s.Srcset = strings.Join(candidates, ", ")
+		return s
+	}
+
+	fallback, alternatives := srcsetFormats(o.preset.Format, o.defaultFormat, o.info)
+	set := srcset{
+		Width:    widths[len(widths)-1],
+		Height:   heightFor(widths[len(widths)-1], ratio),
+		Sources:  []srcsetSource{},
+		Fallback: source(fallback),
+	}
+	for _, f := range alternatives {
+		set.Sources = append(set.Sources, source(f))
+	}
+
+	img := strings.Builder{}
+	img.WriteString(fmt.Sprintf(`<img src="%s" srcset="%s" sizes="%s" width="%d" height="%d" alt="%s" loading="lazy" decoding="async"`,
+		html.EscapeString(set.Fallback.Urls[len(widths)-1].Url),
+		html.EscapeString(set.Fallback.Srcset),
+		html.EscapeString(o.sizes),
+		set.Width, set.Height,
+		html.EscapeString(o.alt),
+	))
+	if o.placeholder != "" {
+		img.WriteString(fmt.Sprintf(` style="background-size: cover; background-image: url(%s)"`, html.EscapeString(o.placeholder)))
+	}
+	img.WriteString(">")
+	set.Img = img.String()
+
+	picture := strings.Builder{}
+	picture.WriteString("<picture>\n")
+	for _, s := range set.Sources {
+		picture.WriteString(fmt.Sprintf("  <source type=\"%s\" srcset=\"%s\" sizes=\"%s\">\n", s.Type, html.EscapeString(s.Srcset), html.EscapeString(o.sizes)))
+	}
+	picture.WriteString("  " + set.Img + "\n")
+	picture.WriteString("</picture>")
+	set.Picture = picture.String()
+	return set
+}
+
+// srcsetWidths returns the requested widths in ascending order, without
+// duplicates and widths above max. max itself is added in their place.
+func srcsetWidths(requested []int, max int) []int {
+	widths := []int{}
+	seen := map[int]bool{}
+	for _, w := range requested {
+		if w > max {
+			w = max
+		}
+		if !seen[w] {
+			seen[w] = true
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// srcsetFormats returns the format every browser can show and the formats to
+// offer before it. Images with transparency fall back to png and animations
+// stay gifs, as other formats would lose either.
+func srcsetFormats(preset, def images.Format, info images.Info) (images.Format, []images.Format) {
+	if info.Frames > 1 && (preset == "" || preset == images.Auto || preset == images.Gif) {
+		return images.Gif, nil
+	}
+	fallback := preset
+	if fallback == "" {
+		fallback = def
+	}
+	if fallback == images.Auto || fallback == images.Webp {
+		fallback = images.Jpeg
+		if info.Alpha {
+			fallback = images.Png
+		}
+	}
+	return fallback, []images.Format{images.Webp}
+}
+
+// parseSrcsetWidths parses a comma separated list of widths, e.g.
+// "320,640,1280".
+func parseSrcsetWidths(str string) ([]int, error) {
+	parts := strings.Split(str, ",")
+	if len(parts) > maxSrcsetWidths {
+		return nil, fmt.Errorf("invalid widths. \n\tGot: %d widths\n\tWant: at most %d", len(parts), maxSrcsetWidths)
+	}
+	widths := make([]int, len(parts))
+	for i, part := range parts {
+		w, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid widths. \n\tGot: '%s'\n\tWant: comma separated widths in pixels, e.g. '320,640,1280'", str)
+		}
+		widths[i] = w
+	}
+	return widths, nil
+}
+
+// heightFor returns the height of an image w pixels wide with the given
+// height to width ratio.
+func heightFor(w int, ratio float64) int {
+	return int(math.Max(1, math.Round(float64(w)*ratio)))
+}
+
+// mediaType returns the media type images of the format are served as.
+func mediaType(f images.Format) string {
+	if f == images.Png8 {
+		return "image/png"
+	}
+	return "image/" + f.String()
+}